@@ -1,6 +1,9 @@
 package brute_force
 
 import (
+	"fmt"
+	"math"
+
 	"github.com/shiyinong/hnsw-go/data"
 	"github.com/shiyinong/hnsw-go/distance"
 	"github.com/shiyinong/hnsw-go/util"
@@ -10,32 +13,104 @@ type Searcher struct {
 	Docs []*data.Doc
 }
 
+// Query returns the nearest k docs, nearest first. It returns nil if a doc has a different dimension
+// from query, use QueryWithScore to get the error.
 func (s *Searcher) Query(query []float32, k int32, disType distance.Type) []*data.Doc {
+	results, _ := s.QueryWithScore(query, k, disType)
+	return data.ResultDocs(results)
+}
+
+// QueryWithScore is like Query, but the distances and scores are returned along with the docs.
+// Vectors are normalized on the fly if the distance requires normalization.
+func (s *Searcher) QueryWithScore(query []float32, k int32, disType distance.Type) ([]*data.Result, error) {
+	if _, ok := distance.FuncMap[disType]; !ok {
+		return nil, fmt.Errorf("%w: unknown distance type: [%v]", util.ErrInvalidParam, disType)
+	}
+	for _, doc := range s.Docs {
+		if err := distance.CheckDimension(doc.Vector, query); err != nil {
+			return nil, err
+		}
+	}
 	topK := util.NewMaxHeap()
 
-	lengthMap := make(map[int]int)
+	disFunc := distance.BoundedFuncMap[disType]
+	normalize := disType.Properties().RequiresNormalization
+	var buf []float32
+	if normalize {
+		query, buf = distance.Normalize(query), make([]float32, len(query))
+	}
+	for _, doc := range s.Docs {
+		bound := float32(math.MaxFloat32)
+		if topK.Size() >= int(k) {
+			bound = topK.Top().GetValue()
+		}
+		dis := disFunc(vectorOf(doc.Vector, buf, normalize), query, bound)
+		if topK.Size() < int(k) {
+			topK.Push(&data.Element{Doc: doc, Distance: dis})
+		} else if dis < bound {
+			topK.PopAndPush(&data.Element{Doc: doc, Distance: dis})
+		}
+	}
+
+	scoreFunc := distance.ScoreFuncMap[disType]
+	res := make([]*data.Result, topK.Size())
+	for i := len(res) - 1; i >= 0; i-- {
+		ele := topK.Pop().(*data.Element)
+		res[i] = &data.Result{
+			Doc:      ele.Doc,
+			Distance: ele.Distance,
+			Score:    scoreFunc(ele.Distance),
+		}
+	}
+	return res, nil
+}
+
+// SearchRange returns all docs whose distance to query is not greater than radius with their distances and
+// scores, nearest first.
+func (s *Searcher) SearchRange(query []float32, radius float32, disType distance.Type) ([]*data.Result, error) {
+	if _, ok := distance.FuncMap[disType]; !ok {
+		return nil, fmt.Errorf("%w: unknown distance type: [%v]", util.ErrInvalidParam, disType)
+	}
+	for _, doc := range s.Docs {
+		if err := distance.CheckDimension(doc.Vector, query); err != nil {
+			return nil, err
+		}
+	}
 	disFunc := distance.FuncMap[disType]
+	normalize := disType.Properties().RequiresNormalization
+	var buf []float32
+	if normalize {
+		query, buf = distance.Normalize(query), make([]float32, len(query))
+	}
+	minHeap := util.NewMinHeap()
 	for _, doc := range s.Docs {
 		ele := &data.Element{
 			Doc:      doc,
-			Distance: disFunc(doc.Vector, query),
+			Distance: disFunc(vectorOf(doc.Vector, buf, normalize), query),
 		}
-		lengthMap[int(1000*ele.Distance)]++
-		if topK.Size() < int(k) {
-			topK.Push(ele)
-			continue
+		if ele.Distance <= radius {
+			minHeap.Push(ele)
 		}
+	}
 
-		dis := disFunc(query, topK.Top().(*data.Element).Doc.Vector)
-		if ele.Distance >= dis {
-			continue
-		}
-		topK.PopAndPush(ele)
+	scoreFunc := distance.ScoreFuncMap[disType]
+	res := make([]*data.Result, 0, minHeap.Size())
+	for minHeap.Size() > 0 {
+		ele := minHeap.Pop().(*data.Element)
+		res = append(res, &data.Result{
+			Doc:      ele.Doc,
+			Distance: ele.Distance,
+			Score:    scoreFunc(ele.Distance),
+		})
 	}
+	return res, nil
+}
 
-	res := []*data.Doc{}
-	for topK.Size() > 0 {
-		res = append(res, topK.Pop().(*data.Element).Doc)
+// vectorOf returns vec normalized into buf if normalize is set, otherwise vec itself.
+func vectorOf(vec, buf []float32, normalize bool) []float32 {
+	if !normalize {
+		return vec
 	}
-	return res
+	distance.NormalizeTo(buf, vec)
+	return buf
 }
@@ -0,0 +1,77 @@
+package hnsw
+
+import (
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/shiyinong/hnsw-go/data"
+)
+
+// BatchStat is the statistics of a SearchBatch call.
+type BatchStat struct {
+	// distance computations of all queries
+	ComputeCnt int64
+	// distance computations of the most expensive query
+	MaxComputeCnt int64
+	Cost          time.Duration
+}
+
+// SearchBatch searches the nearest k docs of every query with HNSW.BatchWorkers goroutines,
+// results are returned in the order of queries. If some queries fail, the error of the first one is returned,
+// and their results are nil.
+func (h *HNSW) SearchBatch(queries [][]float32, k, ef int32) ([][]*data.Result, BatchStat, error) {
+	h.initOnce.Do(h.initLocks)
+	start := time.Now()
+	workers := int(h.BatchWorkers)
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	if workers > len(queries) {
+		workers = len(queries)
+	}
+
+	results := make([][]*data.Result, len(queries))
+	errs := make([]error, len(queries))
+	stats := make([]BatchStat, workers)
+	next := make(chan int, len(queries))
+	for i := range queries {
+		next <- i
+	}
+	close(next)
+	wg := sync.WaitGroup{}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(stat *BatchStat) {
+			defer wg.Done()
+			s := h.getScratch()
+			defer h.putScratch(s)
+			for i := range next {
+				h.globalLock.RLock()
+				results[i], errs[i] = h.searchKNN(queries[i], ef, k, 0, s)
+				h.globalLock.RUnlock()
+				stat.ComputeCnt += s.computeCnt
+				if s.computeCnt > stat.MaxComputeCnt {
+					stat.MaxComputeCnt = s.computeCnt
+				}
+				h.flushScratch(s)
+			}
+		}(&stats[w])
+	}
+	wg.Wait()
+
+	stat := BatchStat{}
+	for _, st := range stats {
+		stat.ComputeCnt += st.ComputeCnt
+		if st.MaxComputeCnt > stat.MaxComputeCnt {
+			stat.MaxComputeCnt = st.MaxComputeCnt
+		}
+	}
+	stat.Cost = time.Since(start)
+	for _, err := range errs {
+		if err != nil {
+			return results, stat, err
+		}
+	}
+	return results, stat, nil
+}
@@ -0,0 +1,112 @@
+package hnsw
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/shiyinong/hnsw-go/data"
+	"github.com/shiyinong/hnsw-go/distance"
+	"github.com/shiyinong/hnsw-go/util"
+)
+
+// default number of insertions between two Progress calls
+const defaultProgressInterval = 10000
+
+type BuildOptions struct {
+	M       int32
+	EfCons  int32
+	Mode    Mode
+	DisType distance.Type
+	// called every ProgressInterval insertions with the number of inserted docs and the time since the build started,
+	// calls are serialized
+	Progress         func(inserted int, cost time.Duration)
+	ProgressInterval int
+	// seed of level generation, 0 means seeded by current time
+	Seed int64
+	// see HNSW.SetNormalize
+	Normalize bool
+	// options of Heuristic mode, nil means DefaultHeuristicOptions()
+	Heuristic *HeuristicOptions
+}
+
+// BuildFromDocs builds an index of docs with workers goroutines, runtime.NumCPU() is used if workers is not positive.
+// The doc ids must be dense, that is, docs[i].Id == i. The build stops at the first failed insertion.
+// The graph is determined by opts.Seed only if workers is 1, otherwise it depends on the order of concurrent insertions.
+func BuildFromDocs(docs []*data.Doc, opts BuildOptions, workers int) (*HNSW, error) {
+	h, err := NewHNSW(opts.M, opts.EfCons, opts.Mode, opts.DisType)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Seed != 0 {
+		h.SetSeed(opts.Seed)
+	}
+	if err = h.SetNormalize(opts.Normalize); err != nil {
+		return nil, err
+	}
+	if opts.Heuristic != nil {
+		h.HeuristicOptions = *opts.Heuristic
+	}
+	for i, doc := range docs {
+		if doc == nil || doc.Id != int32(i) {
+			return nil, fmt.Errorf("%w: doc at [%v] should have id [%v]", util.ErrInvalidId, i, i)
+		}
+	}
+	if len(docs) == 0 {
+		return h, nil
+	}
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	interval := opts.ProgressInterval
+	if interval <= 0 {
+		interval = defaultProgressInterval
+	}
+
+	start := time.Now()
+	// the first doc is inserted alone, so that the others have an entry point to start with
+	if err = h.Insert(docs[0]); err != nil {
+		return nil, err
+	}
+	h.globalLock.Lock()
+	h.grow(int32(len(docs) - 1))
+	h.globalLock.Unlock()
+	inserted := int64(1)
+	next := int64(0)
+	progressLock, errLock := sync.Mutex{}, sync.Mutex{}
+	wg := sync.WaitGroup{}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				i := atomic.AddInt64(&next, 1)
+				if i >= int64(len(docs)) {
+					return
+				}
+				if insertErr := h.Insert(docs[i]); insertErr != nil {
+					errLock.Lock()
+					if err == nil {
+						err = insertErr
+					}
+					errLock.Unlock()
+					// let the other workers stop
+					atomic.StoreInt64(&next, int64(len(docs)))
+					return
+				}
+				if cnt := atomic.AddInt64(&inserted, 1); opts.Progress != nil && cnt%int64(interval) == 0 {
+					progressLock.Lock()
+					opts.Progress(int(cnt), time.Since(start))
+					progressLock.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
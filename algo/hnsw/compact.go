@@ -0,0 +1,73 @@
+package hnsw
+
+import (
+	"github.com/shiyinong/hnsw-go/data"
+)
+
+// Compact removes the deleted docs from the index physically, the alive docs are renumbered densely
+// in their original order. The docs of the index are replaced by copies carrying the new ids, docs
+// passed to Insert are not modified.
+// It returns the mapping from old id to new id, -1 means the doc has been removed.
+func (h *HNSW) Compact() []int32 {
+	h.initOnce.Do(h.initLocks)
+	h.maintainLock.Lock()
+	defer h.maintainLock.Unlock()
+	h.globalLock.Lock()
+	defer h.globalLock.Unlock()
+
+	// reconnect the links to deleted docs before they disappear
+	for id, layers := range h.Neighbors {
+		if h.Docs[id] == nil || h.isDeleted(int32(id)) {
+			continue
+		}
+		for layer, neighbors := range layers {
+			for _, n := range neighbors {
+				if h.isDeleted(n.Doc.Id) {
+					h.repairNeighbors(int32(id), n.Doc.Id, int32(layer))
+				}
+			}
+		}
+	}
+
+	mapping := make([]int32, len(h.Docs))
+	docs := make([]*data.Doc, 0, len(h.Docs))
+	for id, doc := range h.Docs {
+		if doc == nil || h.isDeleted(int32(id)) {
+			mapping[id] = -1
+			continue
+		}
+		newDoc := *doc
+		newDoc.Id = int32(len(docs))
+		mapping[id] = newDoc.Id
+		docs = append(docs, &newDoc)
+	}
+	neighbors := make([][][]*Neighbor, len(docs))
+	for id, layers := range h.Neighbors {
+		if mapping[id] < 0 {
+			continue
+		}
+		newLayers := make([][]*Neighbor, len(layers))
+		for layer, ns := range layers {
+			newNs := make([]*Neighbor, 0, len(ns))
+			for _, n := range ns {
+				if newId := mapping[n.Doc.Id]; newId >= 0 {
+					newNs = append(newNs, &Neighbor{
+						Doc: docs[newId],
+						Dis: n.Dis,
+					})
+				}
+			}
+			newLayers[layer] = newNs
+		}
+		neighbors[mapping[id]] = newLayers
+	}
+
+	h.Docs = docs
+	h.Neighbors = neighbors
+	h.Deleted = make([]bool, len(docs))
+	h.initLocks()
+	if h.EntryPoint != nil {
+		h.EntryPoint = docs[mapping[h.EntryPoint.Id]]
+	}
+	return mapping
+}
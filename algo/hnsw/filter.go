@@ -0,0 +1,84 @@
+package hnsw
+
+import (
+	"math"
+
+	"github.com/shiyinong/hnsw-go/data"
+	"github.com/shiyinong/hnsw-go/util"
+)
+
+const (
+	// number of docs sampled to estimate how many docs are accepted by a filter
+	filterSampleCnt = 1000
+	// an exact scan is used if the filter accepts less than this ratio of docs
+	filterExactRatio = 0.01
+)
+
+// SearchKNNFiltered returns the nearest k docs which are accepted by allow. Docs rejected by allow are
+// still passed through during traversal. If allow is very selective, the accepted docs are scanned
+// exactly instead, because the graph search can hardly reach them.
+// It returns nil if the index is empty or query has a wrong dimension.
+func (h *HNSW) SearchKNNFiltered(query []float32, k, ef int32, allow func(id int32) bool) []*data.Doc {
+	results, _, _ := h.Search(query, SearchOptions{
+		K:      k,
+		Ef:     ef,
+		Filter: allow,
+	})
+	return data.ResultDocs(results)
+}
+
+// estimateAcceptRatio samples the docs evenly and returns the ratio of them accepted by allow,
+// h.globalLock must be held.
+func (h *HNSW) estimateAcceptRatio(allow func(id int32) bool) float64 {
+	h.slotLock.RLock()
+	defer h.slotLock.RUnlock()
+	step := util.Max(len(h.Docs)/filterSampleCnt, 1)
+	sampled, accepted := 0, 0
+	for id := 0; id < len(h.Docs); id += step {
+		if h.Docs[id] == nil || h.isDeleted(int32(id)) {
+			continue
+		}
+		sampled++
+		if allow(int32(id)) {
+			accepted++
+		}
+	}
+	if sampled == 0 {
+		return 0
+	}
+	return float64(accepted) / float64(sampled)
+}
+
+// scanFiltered computes the distance to every doc accepted by allow and returns the nearest k of them,
+// h.globalLock must be held.
+func (h *HNSW) scanFiltered(query []float32, k int32, allow func(id int32) bool, s *scratch) *util.Heap {
+	result := s.result
+	result.Reset()
+	s.resetElements()
+	visitedCnt, heapOpCnt := int64(0), int64(0)
+	h.slotLock.RLock()
+	defer h.slotLock.RUnlock()
+	for id, doc := range h.Docs {
+		if doc == nil || !h.accept(int32(id), allow) {
+			continue
+		}
+		bound := float32(math.MaxFloat32)
+		if int32(result.Size()) >= k {
+			bound = result.Top().GetValue()
+		}
+		ele := s.newElement(doc, h.BoundedDisFunc(query, doc.Vector, bound))
+		s.computeCnt++
+		visitedCnt++
+		if int32(result.Size()) < k {
+			result.Push(ele)
+			heapOpCnt++
+		} else if result.Top().GetValue() > ele.Distance {
+			result.PopAndPush(ele)
+			heapOpCnt++
+		}
+	}
+	if s.stats != nil {
+		s.stats.AddLayer(0, visitedCnt, 0, heapOpCnt)
+	}
+	return result
+}
@@ -0,0 +1,258 @@
+package hnsw
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+
+	"github.com/shiyinong/hnsw-go/data"
+	"github.com/shiyinong/hnsw-go/distance"
+	"github.com/shiyinong/hnsw-go/util"
+)
+
+// FlatHNSW is a frozen, search-only snapshot of an HNSW in a flat memory layout, it is not a storage mode of
+// HNSW: docs can not be inserted into, updated in or deleted from it, and the HNSW it is taken from keeps its
+// own memory.
+// All vectors are stored in one contiguous float32 arena, and the neighbors of a doc at a layer are stored in
+// a fixed-capacity block of int32 ids, so searches have better cache locality and little pressure on GC,
+// and the snapshot takes much less memory than HNSW once the HNSW is dropped.
+// It is safe to search a FlatHNSW from multiple goroutines.
+type FlatHNSW struct {
+	// vectors of docs are slices of the arena, nil for the ids never inserted
+	Docs []*data.Doc
+	// size of the dynamic candidate list for search
+	Ef       int32
+	MaxLayer int32
+
+	DisType        distance.Type
+	DisFunc        func(vec1, vec2 []float32) float32
+	BoundedDisFunc distance.BoundedFunc
+	Normalize      bool
+
+	ComputeCnt int64
+
+	dim        int
+	vectors    []float32
+	entryPoint int32
+	deleted    []bool
+	// Doc id -> max layer of the doc, -1 for the ids never inserted
+	levels []int32
+	// capacity of the neighbor blocks at layer 0 and upper layers, M0 and M of the HNSW
+	cap0, capUpper int32
+	// block of doc id at layer 0 starts at id*(cap0+1), the first element is the neighbor count
+	layer0 []int32
+	// block of doc id at layer l > 0 starts at upperStart[id]+(l-1)*(capUpper+1)
+	upper      []int32
+	upperStart []int
+
+	scratchPool sync.Pool
+}
+
+// Flatten takes a search-only snapshot of the index in a flat memory layout, later changes of h are not
+// reflected. Take a new snapshot to search the changes.
+func (h *HNSW) Flatten() (*FlatHNSW, error) {
+	h.initOnce.Do(h.initLocks)
+	h.globalLock.RLock()
+	defer h.globalLock.RUnlock()
+	h.slotLock.RLock()
+	defer h.slotLock.RUnlock()
+	if h.EntryPoint == nil {
+		return nil, util.ErrEmptyIndex
+	}
+	size := len(h.Docs)
+	f := &FlatHNSW{
+		Docs:           make([]*data.Doc, size),
+		Ef:             h.Ef,
+		MaxLayer:       h.MaxLayer,
+		DisType:        h.DisType,
+		DisFunc:        h.DisFunc,
+		BoundedDisFunc: h.BoundedDisFunc,
+		Normalize:      h.Normalize,
+		dim:            len(h.EntryPoint.Vector),
+		entryPoint:     h.EntryPoint.Id,
+		cap0:           h.M0,
+		capUpper:       h.M,
+		deleted:        make([]bool, size),
+		levels:         make([]int32, size),
+		upperStart:     make([]int, size),
+	}
+	neighbors := make([][][]*Neighbor, size)
+	upperBlocks := 0
+	for id := range h.Docs {
+		f.levels[id] = -1
+		if h.Docs[id] == nil {
+			continue
+		}
+		f.deleted[id] = h.isDeleted(int32(id))
+		h.nodeLocks[id].RLock()
+		neighbors[id] = make([][]*Neighbor, len(h.Neighbors[id]))
+		copy(neighbors[id], h.Neighbors[id])
+		h.nodeLocks[id].RUnlock()
+		f.levels[id] = int32(len(neighbors[id]) - 1)
+		upperBlocks += len(neighbors[id]) - 1
+		for layer, ns := range neighbors[id] {
+			// the neighbors are pruned to M0 and M, growing the blocks is only a safeguard
+			if layer == 0 {
+				f.cap0 = util.Max(f.cap0, int32(len(ns)))
+			} else {
+				f.capUpper = util.Max(f.capUpper, int32(len(ns)))
+			}
+		}
+	}
+
+	f.vectors = make([]float32, size*f.dim)
+	f.layer0 = make([]int32, size*int(f.cap0+1))
+	f.upper = make([]int32, 0, upperBlocks*int(f.capUpper+1))
+	for id, doc := range h.Docs {
+		if doc == nil {
+			continue
+		}
+		vector := f.vectors[id*f.dim : (id+1)*f.dim : (id+1)*f.dim]
+		copy(vector, doc.Vector)
+		newDoc := *doc
+		newDoc.Vector = vector
+		f.Docs[id] = &newDoc
+
+		f.upperStart[id] = len(f.upper)
+		for layer, ns := range neighbors[id] {
+			var block []int32
+			if layer == 0 {
+				block = f.layer0[id*int(f.cap0+1) : (id+1)*int(f.cap0+1)]
+			} else {
+				f.upper = append(f.upper, make([]int32, f.capUpper+1)...)
+				block = f.upper[len(f.upper)-int(f.capUpper+1):]
+			}
+			block[0] = int32(len(ns))
+			for i, n := range ns {
+				block[i+1] = n.Doc.Id
+			}
+		}
+	}
+	return f, nil
+}
+
+// SearchKNN is the same as HNSW.SearchKNN.
+func (f *FlatHNSW) SearchKNN(query []float32, ef, k, ignoreLayer int32) []*data.Doc {
+	results, _ := f.SearchKNNWithScore(query, ef, k, ignoreLayer)
+	return data.ResultDocs(results)
+}
+
+// SearchKNNWithScore is the same as HNSW.SearchKNNWithScore.
+func (f *FlatHNSW) SearchKNNWithScore(query []float32, ef, k, ignoreLayer int32) ([]*data.Result, error) {
+	if len(query) != f.dim {
+		return nil, fmt.Errorf("%w: index dim: [%v] != query dim: [%v]", util.ErrDimensionMismatch, f.dim, len(query))
+	}
+	if k < 1 {
+		return nil, fmt.Errorf("%w: k: [%v] should be positive", util.ErrInvalidParam, k)
+	}
+	if ef <= 0 {
+		ef = f.Ef
+	}
+	ef = util.Max(ef, k)
+	s, ok := f.scratchPool.Get().(*scratch)
+	if !ok {
+		s = newScratch()
+	}
+	defer func() {
+		atomic.AddInt64(&f.ComputeCnt, s.computeCnt)
+		s.computeCnt = 0
+		s.resetElements()
+		f.scratchPool.Put(s)
+	}()
+	query = s.normalizeQuery(query, f.Normalize)
+	entryPoint := f.entryPoint
+	if ignoreLayer == 0 {
+		for layer := f.MaxLayer; layer > 0; layer-- {
+			entryPoint = f.searchAtLayerWith1Ef(query, entryPoint, layer, s)
+		}
+	}
+	result := f.searchAtLayer(query, entryPoint, ef, s)
+	for result.Size() > int(k) {
+		result.Pop()
+	}
+	return popResults(result, f.DisType), nil
+}
+
+// neighbors returns the neighbor ids of doc id at layer.
+func (f *FlatHNSW) neighbors(id, layer int32) []int32 {
+	if layer > f.levels[id] {
+		return nil
+	}
+	var block []int32
+	if layer == 0 {
+		block = f.layer0[int(id)*int(f.cap0+1):]
+	} else {
+		block = f.upper[f.upperStart[id]+int(layer-1)*int(f.capUpper+1):]
+	}
+	return block[1 : 1+block[0]]
+}
+
+func (f *FlatHNSW) vector(id int32) []float32 {
+	return f.vectors[int(id)*f.dim : int(id+1)*f.dim]
+}
+
+func (f *FlatHNSW) searchAtLayer(query []float32, enterPoint, ef int32, s *scratch) *util.Heap {
+	candidates, result := s.candidates, s.result
+	candidates.Reset()
+	result.Reset()
+	s.resetElements()
+	ele := s.newElement(f.Docs[enterPoint], f.DisFunc(query, f.vector(enterPoint)))
+	candidates.Push(ele)
+	if !f.deleted[enterPoint] {
+		result.Push(ele)
+	}
+	s.visited.reset(len(f.Docs))
+	s.visited.visit(enterPoint)
+	for candidates.Size() > 0 {
+		candidate := candidates.Pop().(*data.Element)
+		if int32(result.Size()) >= ef && candidate.Distance > result.Top().GetValue() {
+			break
+		}
+		for _, id := range f.neighbors(candidate.Doc.Id, 0) {
+			if s.visited.visit(id) {
+				continue
+			}
+			bound := float32(math.MaxFloat32)
+			if int32(result.Size()) >= ef {
+				bound = result.Top().GetValue()
+			}
+			dis := f.BoundedDisFunc(f.vector(id), query, bound)
+			s.computeCnt++
+			if int32(result.Size()) >= ef && bound <= dis {
+				continue
+			}
+			newEle := s.newElement(f.Docs[id], dis)
+			candidates.Push(newEle)
+			if f.deleted[id] {
+				continue
+			}
+			if int32(result.Size()) < ef {
+				result.Push(newEle)
+			} else {
+				result.PopAndPush(newEle)
+			}
+		}
+	}
+	return result
+}
+
+func (f *FlatHNSW) searchAtLayerWith1Ef(query []float32, enterPoint, layer int32, s *scratch) int32 {
+	maxDis := f.DisFunc(f.vector(enterPoint), query)
+	for {
+		findBetter := false
+		for _, id := range f.neighbors(enterPoint, layer) {
+			dis := f.BoundedDisFunc(query, f.vector(id), maxDis)
+			s.computeCnt++
+			if dis < maxDis {
+				enterPoint = id
+				maxDis = dis
+				findBetter = true
+			}
+		}
+		if !findBetter {
+			break
+		}
+	}
+	return enterPoint
+}
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"math"
 	"math/rand"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/shiyinong/hnsw-go/data"
@@ -18,13 +20,36 @@ var (
 	Heuristic Mode = 1
 )
 
+// HeuristicOptions are the switches of the heuristic neighbor selection (Algorithm 4 of the paper),
+// they are ignored in Simple mode.
+type HeuristicOptions struct {
+	// extend the candidates of a new doc with their neighbors before the selection
+	ExtendCandidates bool
+	// fill up the neighbors with the pruned candidates, nearest first
+	KeepPrunedConnections bool
+	// a candidate is pruned if its distance to the doc is greater than Alpha times its distance to a selected
+	// neighbor, values greater than 1 keep more long links. 1 is used if not positive. It only makes sense
+	// for non-negative distances, so it should be 1 for distance.InnerProduct
+	Alpha float32
+}
+
+// DefaultHeuristicOptions returns the options used by BuildHNSW.
+func DefaultHeuristicOptions() HeuristicOptions {
+	return HeuristicOptions{
+		KeepPrunedConnections: true,
+		Alpha:                 1,
+	}
+}
+
 type HNSW struct {
-	// all Doc
+	// Doc id -> Doc, nil for the ids not inserted. Slots beyond the largest id are reserved for insertions
 	Docs []*data.Doc
 	// size of the dynamic candidate list for insertion
 	EfCons int32
 	// size of the dynamic candidate list for search
 	Ef int32
+	// recall and latency of the ef values measured by TuneEf, sorted by ef
+	EfCurve []EfPoint
 	// friend number of per node at a layer expect layer 0
 	M int32
 	// friend number of per node at layer 0, recommend value: 2*M
@@ -33,9 +58,13 @@ type HNSW struct {
 	NormFactor float64
 
 	Mode Mode
+	// options of Heuristic mode, should not be changed during insertions
+	HeuristicOptions
 
 	// Doc id -> layer id -> Neighbor Doc
-	Neighbors  [][][]*Neighbor
+	Neighbors [][][]*Neighbor
+	// Doc id -> whether the Doc has been deleted
+	Deleted    []bool
 	EntryPoint *data.Doc
 	MaxLayer   int32
 
@@ -43,8 +72,31 @@ type HNSW struct {
 
 	DisType distance.Type
 	DisFunc func(vec1, vec2 []float32) float32
+	// DisFunc which stops early once the distance exceeds the bound, used to discard far neighbors in searches
+	BoundedDisFunc distance.BoundedFunc
+	// vectors of docs and queries are normalized to unit length, only for distance.Cosine and the distances
+	// requiring it. Set by SetNormalize
+	Normalize bool
 
+	// total distance computations of all insertions and searches, use SearchKNNWithStats for a single search
 	ComputeCnt int64
+
+	// number of goroutines used by SearchBatch, runtime.NumCPU() if not positive
+	BatchWorkers int32
+
+	// held for reading during Insert, for writing by operations that renumber docs
+	maintainLock sync.RWMutex
+	// guards the Docs, Neighbors and Deleted slices, EntryPoint and MaxLayer. Insertions hold it for reading,
+	// and for writing only to grow the slices or to raise the entry point
+	globalLock sync.RWMutex
+	// guards the slots of Docs and Rand, held for writing while an insertion fills the slot of its doc, and for
+	// reading to scan Docs or to read the slot of an id not found through the graph
+	slotLock sync.RWMutex
+	// Doc id -> lock of Neighbors[id]
+	nodeLocks []*sync.RWMutex
+	initOnce  sync.Once
+	// pool of *scratch
+	scratchPool sync.Pool
 }
 
 type Neighbor struct {
@@ -52,55 +104,185 @@ type Neighbor struct {
 	Dis float32
 }
 
-func (h *HNSW) Stat() {
+// Stat prints the params and the layer distribution of the index, it returns util.ErrEmptyIndex if no doc
+// has been inserted.
+func (h *HNSW) Stat() error {
+	h.initOnce.Do(h.initLocks)
+	h.globalLock.RLock()
+	defer h.globalLock.RUnlock()
+	h.slotLock.RLock()
+	defer h.slotLock.RUnlock()
+	dim := h.dimension()
+	if dim < 0 {
+		return util.ErrEmptyIndex
+	}
+	// Docs may have empty slots, which are reserved for the following insertions
+	size := 0
+	for _, doc := range h.Docs {
+		if doc != nil {
+			size++
+		}
+	}
 	fmt.Printf("HNSW params:\nM: [%v], M0: [%v], EfCons: [%v], Mode: [%v], EF: [%v], NormFactor: [%.2f], DataSize: [%v], Dim: [%v]\n",
-		h.M, h.M0, h.EfCons, h.Mode, h.Ef, h.NormFactor, len(h.Docs), len(h.Docs[0].Vector))
-	arr := make([]int, h.MaxLayer+1)
-	connCnt := make([]int, h.MaxLayer+1)
+		h.M, h.M0, h.EfCons, h.Mode, h.Ef, h.NormFactor, size, dim)
+	// a deleted doc may keep layers above h.MaxLayer after the entry point is re-elected
+	layers := int(h.MaxLayer) + 1
 	for _, n := range h.Neighbors {
+		if len(n) > layers {
+			layers = len(n)
+		}
+	}
+	arr := make([]int, layers)
+	connCnt := make([]int, layers)
+	for id, n := range h.Neighbors {
+		if len(n) == 0 {
+			// empty slot
+			continue
+		}
+		h.nodeLocks[id].RLock()
 		arr[len(n)-1]++
 		for i, v := range n {
 			connCnt[i] += len(v)
 		}
+		h.nodeLocks[id].RUnlock()
 	}
 	cnt := 0
 	for i := len(arr) - 1; i >= 0; i-- {
 		cnt += arr[i]
 		fmt.Printf("layer id: [%v],\tnode count: [%v],\tavg neighbors count: [%v]\n", i, cnt, connCnt[i]/cnt)
 	}
+	return nil
+}
+
+// NewHNSW is like BuildHNSW, but the params are checked.
+func NewHNSW(m, efCons int32, mode Mode, disType distance.Type) (*HNSW, error) {
+	if m < 2 {
+		return nil, fmt.Errorf("%w: m: [%v] should be at least 2", util.ErrInvalidParam, m)
+	}
+	if efCons < 1 {
+		return nil, fmt.Errorf("%w: efCons: [%v] should be positive", util.ErrInvalidParam, efCons)
+	}
+	if mode != Simple && mode != Heuristic {
+		return nil, fmt.Errorf("%w: unknown mode: [%v]", util.ErrInvalidParam, mode)
+	}
+	if _, ok := distance.FuncMap[disType]; !ok {
+		return nil, fmt.Errorf("%w: unknown distance type: [%v]", util.ErrInvalidParam, disType)
+	}
+	return BuildHNSW(m, efCons, mode, disType), nil
 }
 
 func BuildHNSW(m, efCons int32, mode Mode, disType distance.Type) *HNSW {
 	return &HNSW{
-		EfCons:     efCons,
-		M:          m,
-		M0:         2 * m,
-		NormFactor: 1 / math.Log(float64(m)),
-		DisType:    disType,
-		DisFunc:    distance.FuncMap[disType],
-		Rand:       rand.New(rand.NewSource(time.Now().UnixMicro())),
-		Mode:       mode,
+		EfCons:         efCons,
+		M:              m,
+		M0:             2 * m,
+		NormFactor:     1 / math.Log(float64(m)),
+		DisType:        disType,
+		DisFunc:        distance.FuncMap[disType],
+		BoundedDisFunc: distance.BoundedFuncMap[disType],
+		Normalize:      disType.Properties().RequiresNormalization,
+		Rand:           rand.New(rand.NewSource(time.Now().UnixMicro())),
+		Mode:           mode,
+
+		HeuristicOptions: DefaultHeuristicOptions(),
 	}
 }
 
-func (h *HNSW) Insert(newDoc *data.Doc) {
-	h.Docs = append(h.Docs, newDoc)
-	maxLayerForNew := int32(math.Floor(-math.Log(h.Rand.Float64()) * h.NormFactor))
-	h.Neighbors = append(h.Neighbors, make([][]*Neighbor, maxLayerForNew+1))
-	if h.EntryPoint == nil {
-		h.MaxLayer = maxLayerForNew
-		h.EntryPoint = newDoc
-		return
+// SetSeed reseeds the random source of level generation. Inserting the same docs in the same order into
+// indexes with the same seed and params builds identical graphs.
+func (h *HNSW) SetSeed(seed int64) {
+	h.globalLock.Lock()
+	defer h.globalLock.Unlock()
+	h.Rand = rand.New(rand.NewSource(seed))
+}
+
+// SetNormalize sets whether the vectors are normalized, it is only allowed for distance.Cosine and must be
+// called before any insertion, it returns util.ErrInvalidParam if the index has docs. The cosine distance of unit vectors is computed as 1 - inner product, which is
+// cheaper than distance.CosineDistance. The vectors are always normalized for the distances requiring it.
+func (h *HNSW) SetNormalize(normalize bool) error {
+	required := h.DisType.Properties().RequiresNormalization
+	if normalize && h.DisType != distance.Cosine && !required {
+		return fmt.Errorf("%w: normalization is only for cosine distance, distance type: [%v]",
+			util.ErrInvalidParam, h.DisType)
+	}
+	h.globalLock.Lock()
+	defer h.globalLock.Unlock()
+	if len(h.Docs) > 0 {
+		return fmt.Errorf("%w: normalization can not be changed after insertion", util.ErrInvalidParam)
 	}
-	entryPoint := h.EntryPoint
-	for curLayer := h.MaxLayer; curLayer > maxLayerForNew; curLayer-- {
-		entryPoint = h.searchAtLayerWith1Ef(newDoc.Vector, entryPoint, curLayer)
+	h.Normalize = normalize || required
+	h.DisFunc, h.BoundedDisFunc = distance.FuncMap[h.DisType], distance.BoundedFuncMap[h.DisType]
+	if normalize && h.DisType == distance.Cosine {
+		h.DisFunc = distance.NormalizedCosineDistance
+		h.BoundedDisFunc = distance.Unbounded(distance.NormalizedCosineDistance)
 	}
+	return nil
+}
+
+// Insert adds newDoc to the index, newDoc.Id is used as the index of Neighbors, so ids should be dense.
+// Use KeyIndex for arbitrary keys. The index keeps a copy of newDoc, so newDoc is not modified by Insert or by
+// later updates. The vector is shared with newDoc unless h.Normalize is set, it should not be modified.
+// It is safe to call Insert and SearchKNN from multiple goroutines.
+func (h *HNSW) Insert(newDoc *data.Doc) error {
+	h.initOnce.Do(h.initLocks)
+	h.maintainLock.RLock()
+	defer h.maintainLock.RUnlock()
+	return h.insert(newDoc)
+}
 
-	for curLayer := util.Min(maxLayerForNew, h.MaxLayer); curLayer >= 0; curLayer-- {
-		maxHeap := h.searchAtLayer(newDoc.Vector, entryPoint, h.EfCons, curLayer)
-		h.Neighbors[newDoc.Id][curLayer] = h.selectNeighborsFromMaxHeap(maxHeap, h.M)
-		for _, neighbor := range h.Neighbors[newDoc.Id][curLayer] {
+// insert does the work of Insert, h.maintainLock must be held.
+func (h *HNSW) insert(newDoc *data.Doc) error {
+	if newDoc != nil {
+		h.globalLock.RLock()
+		full := int(newDoc.Id) >= len(h.Docs)
+		h.globalLock.RUnlock()
+		if full {
+			h.globalLock.Lock()
+			h.grow(newDoc.Id)
+			h.globalLock.Unlock()
+		}
+	}
+	h.globalLock.RLock()
+	for h.EntryPoint == nil {
+		// the first doc becomes the entry point
+		h.globalLock.RUnlock()
+		h.globalLock.Lock()
+		if h.EntryPoint == nil {
+			doc, layer, err := h.fillSlot(newDoc)
+			if err == nil {
+				h.EntryPoint, h.MaxLayer = doc, layer
+			}
+			h.globalLock.Unlock()
+			return err
+		}
+		h.globalLock.Unlock()
+		h.globalLock.RLock()
+	}
+	newDoc, maxLayerForNew, err := h.fillSlot(newDoc)
+	if err != nil {
+		h.globalLock.RUnlock()
+		return err
+	}
+	entryPoint, maxLayer := h.EntryPoint, h.MaxLayer
+
+	s := h.getScratch()
+	defer h.putScratch(s)
+	for curLayer := maxLayer; curLayer > maxLayerForNew; curLayer-- {
+		entryPoint = h.searchAtLayerWith1Ef(newDoc.Vector, entryPoint, curLayer, s)
+	}
+
+	for curLayer := util.Min(maxLayerForNew, maxLayer); curLayer >= 0; curLayer-- {
+		maxHeap := h.searchAtLayer(newDoc.Vector, entryPoint, h.EfCons, curLayer, nil, s)
+		if h.Mode == Heuristic && h.ExtendCandidates {
+			h.extendCandidates(newDoc, maxHeap, curLayer, s)
+		}
+		neighbors := h.selectNeighborsFromMaxHeap(maxHeap, h.M)
+		h.nodeLocks[newDoc.Id].Lock()
+		h.Neighbors[newDoc.Id][curLayer] = neighbors
+		h.nodeLocks[newDoc.Id].Unlock()
+		for _, neighbor := range neighbors {
+			lock := h.nodeLocks[neighbor.Doc.Id]
+			lock.Lock()
 			h.Neighbors[neighbor.Doc.Id][curLayer] = h.addNeighbor(
 				h.Neighbors[neighbor.Doc.Id][curLayer],
 				&Neighbor{
@@ -109,26 +291,233 @@ func (h *HNSW) Insert(newDoc *data.Doc) {
 				},
 				curLayer,
 			)
+			lock.Unlock()
+		}
+		if len(neighbors) > 0 {
+			entryPoint = neighbors[0].Doc
+		}
+	}
+	h.globalLock.RUnlock()
+
+	if maxLayerForNew > maxLayer {
+		h.globalLock.Lock()
+		if maxLayerForNew > h.MaxLayer {
+			h.MaxLayer = maxLayerForNew
+			h.EntryPoint = newDoc
 		}
-		if len(h.Neighbors[newDoc.Id][curLayer]) > 0 {
-			entryPoint = h.Neighbors[newDoc.Id][curLayer][0].Doc
+		h.globalLock.Unlock()
+	}
+	return nil
+}
+
+// fillSlot puts a copy of newDoc into its slot, which must be within Docs, and draws the max layer of the
+// doc. It returns the copy and its max layer. h.globalLock must be held.
+func (h *HNSW) fillSlot(newDoc *data.Doc) (*data.Doc, int32, error) {
+	h.slotLock.Lock()
+	defer h.slotLock.Unlock()
+	if err := h.checkNewDoc(newDoc); err != nil {
+		return nil, 0, err
+	}
+	doc := *newDoc
+	if h.Normalize {
+		doc.Vector = distance.Normalize(doc.Vector)
+	}
+	maxLayer := int32(math.Floor(-math.Log(h.Rand.Float64()) * h.NormFactor))
+	h.Docs[doc.Id] = &doc
+	h.nodeLocks[doc.Id].Lock()
+	h.Neighbors[doc.Id] = make([][]*Neighbor, maxLayer+1)
+	h.nodeLocks[doc.Id].Unlock()
+	return &doc, maxLayer, nil
+}
+
+// checkNewDoc checks whether newDoc can be inserted, h.globalLock and h.slotLock must be held.
+func (h *HNSW) checkNewDoc(newDoc *data.Doc) error {
+	if newDoc == nil {
+		return fmt.Errorf("%w: doc is nil", util.ErrInvalidParam)
+	}
+	if newDoc.Id < 0 {
+		return fmt.Errorf("%w: [%v]", util.ErrInvalidId, newDoc.Id)
+	}
+	if h.exists(newDoc.Id) {
+		return fmt.Errorf("%w: [%v]", util.ErrDuplicateId, newDoc.Id)
+	}
+	if dim := h.dimension(); dim >= 0 && dim != len(newDoc.Vector) {
+		return fmt.Errorf("%w: index dim: [%v] != doc dim: [%v]", util.ErrDimensionMismatch, dim, len(newDoc.Vector))
+	}
+	return nil
+}
+
+// checkQuery checks whether the index can be searched by query, h.globalLock must be held.
+func (h *HNSW) checkQuery(query []float32) error {
+	if h.EntryPoint == nil {
+		return util.ErrEmptyIndex
+	}
+	return distance.CheckDimension(h.EntryPoint.Vector, query)
+}
+
+// dimension returns the dimension of the docs, or -1 if there is no doc. h.globalLock must be held.
+func (h *HNSW) dimension() int {
+	if h.EntryPoint != nil {
+		return len(h.EntryPoint.Vector)
+	}
+	for _, doc := range h.Docs {
+		if doc != nil {
+			return len(doc.Vector)
 		}
 	}
+	return -1
+}
 
-	if maxLayerForNew > h.MaxLayer {
-		h.MaxLayer = maxLayerForNew
-		h.EntryPoint = newDoc
+// grow makes sure Docs, Neighbors and nodeLocks can be indexed by id. They are at least doubled, so that
+// insertions of increasing ids seldom hold h.globalLock for writing. h.globalLock must be held for writing.
+func (h *HNSW) grow(id int32) {
+	if int(id) < len(h.Docs) {
+		return
+	}
+	size := util.Max(int(id)+1, 2*len(h.Docs))
+	for len(h.Docs) < size {
+		h.Docs = append(h.Docs, nil)
+		h.Neighbors = append(h.Neighbors, nil)
+		h.Deleted = append(h.Deleted, false)
+		h.nodeLocks = append(h.nodeLocks, &sync.RWMutex{})
+	}
+}
+
+// Delete marks the doc as deleted. The doc will not appear in search results any more, but it is still
+// passed through during traversal. Only the neighbors of the doc that link back to it are reconnected with its
+// neighbors, docs with one-way links to it keep them until Compact repairs them.
+// It returns false if the doc does not exist or has been deleted.
+func (h *HNSW) Delete(id int32) bool {
+	h.initOnce.Do(h.initLocks)
+	h.globalLock.Lock()
+	defer h.globalLock.Unlock()
+	if id < 0 || int(id) >= len(h.Docs) || h.Docs[id] == nil || h.isDeleted(id) {
+		return false
+	}
+	for int(id) >= len(h.Deleted) {
+		h.Deleted = append(h.Deleted, false)
+	}
+	h.Deleted[id] = true
+	for layer, neighbors := range h.Neighbors[id] {
+		for _, n := range neighbors {
+			if !h.isDeleted(n.Doc.Id) {
+				h.repairNeighbors(n.Doc.Id, id, int32(layer))
+			}
+		}
+	}
+	if h.EntryPoint.Id == id {
+		h.reelectEntryPoint()
+	}
+	return true
+}
+
+// repairNeighbors removes deletedId from the neighbors of doc id at layer, and fills the hole with the
+// neighbors of deletedId. h.globalLock must be held for writing.
+func (h *HNSW) repairNeighbors(id, deletedId, layer int32) {
+	neighbors := h.Neighbors[id][layer]
+	found := false
+	for _, n := range neighbors {
+		if n.Doc.Id == deletedId {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return
+	}
+	doc := h.Docs[id]
+	maxHeap := util.NewMaxHeap()
+	visited := map[int32]struct{}{id: {}, deletedId: {}}
+	for _, n := range neighbors {
+		if _, ok := visited[n.Doc.Id]; ok {
+			continue
+		}
+		visited[n.Doc.Id] = struct{}{}
+		maxHeap.Push(&data.Element{
+			Doc:      n.Doc,
+			Distance: n.Dis,
+		})
+	}
+	for _, n := range h.Neighbors[deletedId][layer] {
+		if _, ok := visited[n.Doc.Id]; ok || h.isDeleted(n.Doc.Id) {
+			continue
+		}
+		visited[n.Doc.Id] = struct{}{}
+		maxHeap.Push(&data.Element{
+			Doc:      n.Doc,
+			Distance: h.DisFunc(doc.Vector, n.Doc.Vector),
+		})
+		atomic.AddInt64(&h.ComputeCnt, 1)
+	}
+	h.Neighbors[id][layer] = h.selectNeighborsFromMaxHeap(maxHeap, h.getMaxNeighborCnt(layer))
+}
+
+// reelectEntryPoint picks the alive doc with the highest layer as the new entry point,
+// h.globalLock must be held for writing.
+func (h *HNSW) reelectEntryPoint() {
+	h.EntryPoint, h.MaxLayer = nil, 0
+	for id, doc := range h.Docs {
+		if doc == nil || h.isDeleted(int32(id)) {
+			continue
+		}
+		layer := int32(len(h.Neighbors[id]) - 1)
+		if h.EntryPoint == nil || layer > h.MaxLayer {
+			h.EntryPoint, h.MaxLayer = doc, layer
+		}
+	}
+}
+
+// isDeleted reports whether the doc has been deleted, h.globalLock must be held.
+func (h *HNSW) isDeleted(id int32) bool {
+	return int(id) < len(h.Deleted) && h.Deleted[id]
+}
+
+// accept reports whether doc id can be put into search results, h.globalLock must be held.
+func (h *HNSW) accept(id int32, allow func(id int32) bool) bool {
+	return !h.isDeleted(id) && (allow == nil || allow(id))
+}
+
+func (h *HNSW) initLocks() {
+	h.nodeLocks = make([]*sync.RWMutex, len(h.Neighbors))
+	for i := range h.nodeLocks {
+		h.nodeLocks[i] = &sync.RWMutex{}
+	}
+}
+
+// extendCandidates adds the alive neighbors at layer of the docs in maxHeap to maxHeap, doc itself is excluded.
+// h.globalLock must be held, and no node lock may be held by the caller.
+func (h *HNSW) extendCandidates(doc *data.Doc, maxHeap *util.Heap, layer int32, s *scratch) {
+	s.visited.reset(len(h.Docs))
+	s.visited.visit(doc.Id)
+	candidates := make([]*data.Doc, 0, maxHeap.Size())
+	for _, element := range maxHeap.Elements {
+		ele := element.(*data.Element)
+		s.visited.visit(ele.Doc.Id)
+		candidates = append(candidates, ele.Doc)
+	}
+	for _, candidate := range candidates {
+		for _, n := range h.getNeighbors(candidate.Id, layer, s) {
+			if s.visited.visit(n.Doc.Id) || h.isDeleted(n.Doc.Id) {
+				continue
+			}
+			maxHeap.Push(s.newElement(n.Doc, h.DisFunc(doc.Vector, n.Doc.Vector)))
+			s.computeCnt++
+		}
 	}
 }
 
 func (h *HNSW) selectHeuristicNeighborsFromMinHeap(minHeap *util.Heap, maxCnt int32) []*Neighbor {
+	alpha := h.Alpha
+	if alpha <= 0 {
+		alpha = 1
+	}
 	selected, discard := util.NewMinHeap(), util.NewMinHeap()
 	neighbors := []*Neighbor{}
 	for minHeap.Size() > 0 && selected.Size() < int(maxCnt) {
 		cur := minHeap.Pop().(*data.Element)
 		flag := true
 		for _, element := range selected.Elements {
-			if cur.Distance > h.DisFunc(cur.Doc.Vector, element.(*data.Element).Doc.Vector) {
+			if cur.Distance > alpha*h.DisFunc(cur.Doc.Vector, element.(*data.Element).Doc.Vector) {
 				flag = false
 				break
 			}
@@ -139,7 +528,7 @@ func (h *HNSW) selectHeuristicNeighborsFromMinHeap(minHeap *util.Heap, maxCnt in
 			discard.Push(cur)
 		}
 	}
-	for selected.Size() < int(maxCnt) && discard.Size() > 0 {
+	for h.KeepPrunedConnections && selected.Size() < int(maxCnt) && discard.Size() > 0 {
 		selected.Push(discard.Pop())
 	}
 	for selected.Size() > 0 {
@@ -174,63 +563,107 @@ func (h *HNSW) selectNeighborsFromMaxHeap(maxHeap *util.Heap, maxCnt int32) []*N
 	return h.selectHeuristicNeighborsFromMinHeap(minHeap, maxCnt)
 }
 
-func (h *HNSW) searchAtLayer(query []float32, enterPoint *data.Doc, ef, layer int32) *util.Heap {
-	candidates, result := util.NewMinHeap(), util.NewMaxHeap()
-	ele := &data.Element{
-		Doc:      enterPoint,
-		Distance: h.DisFunc(query, enterPoint.Vector),
-	}
+// searchAtLayer returns the nearest ef docs accepted by allow, a nil allow accepts every alive doc.
+// Docs which are not accepted are still passed through.
+func (h *HNSW) searchAtLayer(query []float32, enterPoint *data.Doc, ef, layer int32, allow func(id int32) bool,
+	s *scratch) *util.Heap {
+	candidates, result := s.candidates, s.result
+	candidates.Reset()
+	result.Reset()
+	s.resetElements()
+	ele := s.newElement(enterPoint, h.DisFunc(query, enterPoint.Vector))
+	s.computeCnt++
 	candidates.Push(ele)
-	result.Push(ele)
-	visited := make(map[int32]struct{})
-	visited[enterPoint.Id] = struct{}{}
+	visitedCnt, hopCnt, heapOpCnt := int64(1), int64(0), int64(1)
+	if h.accept(enterPoint.Id, allow) {
+		result.Push(ele)
+		heapOpCnt++
+	}
+	s.visited.reset(len(h.Docs))
+	s.visited.visit(enterPoint.Id)
 	for candidates.Size() > 0 {
 		candidate := candidates.Pop().(*data.Element)
-		if candidate.Distance > result.Top().GetValue() {
+		heapOpCnt++
+		// deleted or filtered docs are never put into result, so result may be not full even if candidate is far away
+		if int32(result.Size()) >= ef && candidate.Distance > result.Top().GetValue() || s.expired() {
 			break
 		}
-		for _, n := range h.Neighbors[candidate.Doc.Id][layer] {
-			if _, ok := visited[n.Doc.Id]; ok {
+		hopCnt++
+		for _, n := range h.getNeighbors(candidate.Doc.Id, layer, s) {
+			if s.visited.visit(n.Doc.Id) {
+				continue
+			}
+			bound := float32(math.MaxFloat32)
+			if int32(result.Size()) >= ef {
+				bound = result.Top().GetValue()
+			}
+			dis := h.BoundedDisFunc(n.Doc.Vector, query, bound)
+			s.computeCnt++
+			visitedCnt++
+			if int32(result.Size()) >= ef && bound <= dis {
 				continue
 			}
-			visited[n.Doc.Id] = struct{}{}
-			newEle := &data.Element{
-				Doc:      n.Doc,
-				Distance: h.DisFunc(n.Doc.Vector, query),
+			newEle := s.newElement(n.Doc, dis)
+			candidates.Push(newEle)
+			heapOpCnt++
+			if !h.accept(n.Doc.Id, allow) {
+				continue
 			}
-			h.ComputeCnt++
+			heapOpCnt++
 			if int32(result.Size()) < ef {
 				result.Push(newEle)
-				candidates.Push(newEle)
-			} else if result.Top().GetValue() > newEle.Distance {
+			} else {
 				result.PopAndPush(newEle)
-				candidates.Push(newEle)
 			}
 		}
 	}
+	if s.stats != nil {
+		s.stats.AddLayer(layer, visitedCnt, hopCnt, heapOpCnt)
+	}
 	return result
 }
 
-func (h *HNSW) searchAtLayerWith1Ef(query []float32, enterPoint *data.Doc, layer int32) *data.Doc {
+func (h *HNSW) searchAtLayerWith1Ef(query []float32, enterPoint *data.Doc, layer int32, s *scratch) *data.Doc {
 	maxDis := h.DisFunc(enterPoint.Vector, query)
+	s.computeCnt++
+	visitedCnt, hopCnt := int64(1), int64(0)
 	for {
 		findBetter := false
-		for _, n := range h.Neighbors[enterPoint.Id][layer] {
-			dis := h.DisFunc(query, n.Doc.Vector)
-			h.ComputeCnt++
+		hopCnt++
+		for _, n := range h.getNeighbors(enterPoint.Id, layer, s) {
+			dis := h.BoundedDisFunc(query, n.Doc.Vector, maxDis)
+			s.computeCnt++
+			visitedCnt++
 			if dis < maxDis {
 				enterPoint = n.Doc
 				maxDis = dis
 				findBetter = true
 			}
 		}
-		if !findBetter {
+		if !findBetter || s.expired() {
 			break
 		}
 	}
+	if s.stats != nil {
+		s.stats.AddLayer(layer, visitedCnt, hopCnt, 0)
+	}
 	return enterPoint
 }
 
+// getNeighbors returns a snapshot of the neighbors of doc id at layer, which is valid until the next
+// getNeighbors with the same scratch. h.globalLock must be held.
+func (h *HNSW) getNeighbors(id, layer int32, s *scratch) []*Neighbor {
+	lock := h.nodeLocks[id]
+	lock.RLock()
+	defer lock.RUnlock()
+	layers := h.Neighbors[id]
+	if int32(len(layers)) <= layer {
+		return nil
+	}
+	s.neighbors = append(s.neighbors[:0], layers[layer]...)
+	return s.neighbors
+}
+
 func (h *HNSW) addNeighbor(neighbors []*Neighbor, newNeighbor *Neighbor, layer int32) []*Neighbor {
 	maxCnt := h.getMaxNeighborCnt(layer)
 	neighbors = append(neighbors, newNeighbor)
@@ -259,20 +692,47 @@ func (h *HNSW) addNeighbor(neighbors []*Neighbor, newNeighbor *Neighbor, layer i
 	return h.selectHeuristicNeighborsFromMinHeap(minHeap, maxCnt)
 }
 
+// SearchKNN returns the nearest k docs, nearest first. It returns nil if the index is empty or query has a
+// wrong dimension, use SearchKNNWithScore to get the error.
 func (h *HNSW) SearchKNN(query []float32, ef, k, ignoreLayer int32) []*data.Doc {
-	entryPoint := h.EntryPoint
-	if ignoreLayer == 0 {
-		for layer := h.MaxLayer; layer > 0; layer-- {
-			entryPoint = h.searchAtLayerWith1Ef(query, entryPoint, layer)
-		}
-	}
-	result := h.searchAtLayer(query, entryPoint, ef, 0)
-	for result.Size() > int(k) {
-		result.Pop()
-	}
-	list := make([]*data.Doc, result.Size())
+	results, _ := h.SearchKNNWithScore(query, ef, k, ignoreLayer)
+	return data.ResultDocs(results)
+}
+
+// SearchKNNWithScore is like SearchKNN, but the distances and scores are returned along with the docs.
+func (h *HNSW) SearchKNNWithScore(query []float32, ef, k, ignoreLayer int32) ([]*data.Result, error) {
+	results, _, err := h.Search(query, knnOptions(ef, k, ignoreLayer))
+	return results, err
+}
+
+// SearchKNNWithStats is like SearchKNNWithScore, but the work done by the search is returned as well.
+func (h *HNSW) SearchKNNWithStats(query []float32, ef, k, ignoreLayer int32) ([]*data.Result, *data.SearchStats,
+	error) {
+	opts := knnOptions(ef, k, ignoreLayer)
+	opts.CollectStats = true
+	return h.Search(query, opts)
+}
+
+// searchKNN does the work of SearchKNNWithScore, h.globalLock must be held.
+func (h *HNSW) searchKNN(query []float32, ef, k, ignoreLayer int32, s *scratch) ([]*data.Result, error) {
+	return h.search(query, knnOptions(ef, k, ignoreLayer), s)
+}
+
+// popResults pops all elements of the max heap result, nearest first.
+func (h *HNSW) popResults(result *util.Heap) []*data.Result {
+	return popResults(result, h.DisType)
+}
+
+func popResults(result *util.Heap, disType distance.Type) []*data.Result {
+	scoreFunc := distance.ScoreFuncMap[disType]
+	list := make([]*data.Result, result.Size())
 	for i := result.Size() - 1; result.Size() > 0; i-- {
-		list[i] = result.Pop().(*data.Element).Doc
+		ele := result.Pop().(*data.Element)
+		list[i] = &data.Result{
+			Doc:      ele.Doc,
+			Distance: ele.Distance,
+			Score:    scoreFunc(ele.Distance),
+		}
 	}
 	return list
 }
@@ -0,0 +1,1354 @@
+package hnsw
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/shiyinong/hnsw-go/algo/brute_force"
+	"github.com/shiyinong/hnsw-go/data"
+	"github.com/shiyinong/hnsw-go/distance"
+	"github.com/shiyinong/hnsw-go/util"
+)
+
+// newTestIndex builds an index of n seeded docs of dimension 8 with a seeded level generation, nil opts means
+// M 6, EfCons 32, Heuristic mode and distance.L2.
+func newTestIndex(t *testing.T, n int32, opts *BuildOptions) ([]*data.Doc, *HNSW) {
+	t.Helper()
+	if opts == nil {
+		opts = &BuildOptions{M: 6, EfCons: 32, Mode: Heuristic, DisType: distance.L2}
+	}
+	if opts.Seed == 0 {
+		opts.Seed = 1
+	}
+	docs := data.BuildAllDocWithSeed(8, n, 1)
+	h, err := BuildFromDocs(docs, *opts, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return docs, h
+}
+
+func TestConcurrentInsertAndSearch(t *testing.T) {
+	docs := data.BuildAllDocWithSeed(8, 2000, 1)
+	h := BuildHNSW(6, 32, Heuristic, distance.L2)
+	h.SetSeed(1)
+	wg := sync.WaitGroup{}
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < len(docs); i += 4 {
+				h.Insert(docs[i])
+			}
+		}(w)
+	}
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < 200; i += 4 {
+				h.SearchKNN(docs[i].Vector, 32, 10, 0)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	for i, doc := range docs {
+		if h.Docs[i] == nil || h.Docs[i].Id != doc.Id {
+			t.Fatalf("doc slot [%v] is not filled by its own doc", i)
+		}
+	}
+	hit := 0
+	for _, doc := range docs[:100] {
+		res := h.SearchKNN(doc.Vector, 32, 1, 0)
+		if len(res) == 1 && res[0].Id == doc.Id {
+			hit++
+		}
+	}
+	if hit < 95 {
+		t.Fatalf("self recall too low: [%v / 100]", hit)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	docs, h := newTestIndex(t, 2000, nil)
+	entryPoint := h.EntryPoint
+	if !h.Delete(entryPoint.Id) {
+		t.Fatalf("delete entry point failed")
+	}
+	if h.Delete(entryPoint.Id) {
+		t.Fatalf("delete a deleted doc should fail")
+	}
+	if h.EntryPoint == entryPoint {
+		t.Fatalf("entry point is not re-elected")
+	}
+	for i := 0; i < len(docs); i += 2 {
+		h.Delete(docs[i].Id)
+	}
+
+	hit := 0
+	for i, doc := range docs {
+		res := h.SearchKNN(doc.Vector, 32, 10, 0)
+		for _, r := range res {
+			if h.Deleted[r.Id] {
+				t.Fatalf("deleted doc [%v] is returned", r.Id)
+			}
+		}
+		if i%2 == 1 && len(res) > 0 && res[0].Id == doc.Id {
+			hit++
+		}
+	}
+	if hit < 950 {
+		t.Fatalf("self recall of alive docs too low: [%v / 1000]", hit)
+	}
+}
+
+func TestStatAfterDelete(t *testing.T) {
+	_, h := newTestIndex(t, 500, nil)
+	// delete the entry points until the top layer is empty, the deleted docs keep their layers
+	maxLayer := h.MaxLayer
+	for h.MaxLayer == maxLayer {
+		h.Delete(h.EntryPoint.Id)
+	}
+	if err := h.Stat(); err != nil {
+		t.Fatalf("stat failed: [%v]", err)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	docs, h := newTestIndex(t, 2000, nil)
+	for i := 0; i < len(docs); i += 2 {
+		h.Delete(docs[i].Id)
+	}
+	mapping := h.Compact()
+	if len(h.Docs) != len(docs)/2 || len(h.Neighbors) != len(docs)/2 {
+		t.Fatalf("index size after compaction: [%v], expect: [%v]", len(h.Docs), len(docs)/2)
+	}
+	for i, doc := range docs {
+		if i%2 == 0 {
+			if mapping[i] != -1 {
+				t.Fatalf("deleted doc [%v] is mapped to [%v]", i, mapping[i])
+			}
+			continue
+		}
+		if mapping[i] != int32(i/2) || h.Docs[mapping[i]].Vector[0] != doc.Vector[0] {
+			t.Fatalf("doc [%v] is mapped to [%v]", i, mapping[i])
+		}
+	}
+
+	hit := 0
+	for i := 1; i < len(docs); i += 2 {
+		res := h.SearchKNN(docs[i].Vector, 32, 1, 0)
+		if len(res) == 1 && res[0].Id == mapping[i] {
+			hit++
+		}
+	}
+	if hit < 950 {
+		t.Fatalf("self recall after compaction too low: [%v / 1000]", hit)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	docs, h := newTestIndex(t, 2000, nil)
+	h.Delete(docs[1].Id)
+	if h.Update(docs[1].Id, data.BuildDoc(0, 8).Vector) {
+		t.Fatalf("update a deleted doc should fail")
+	}
+	for i := 0; i < len(docs); i += 2 {
+		if !h.Update(docs[i].Id, data.BuildDoc(0, 8).Vector) {
+			t.Fatalf("update doc [%v] failed", i)
+		}
+	}
+	h.Upsert(data.BuildDoc(docs[1].Id, 8))
+	h.Upsert(data.BuildDoc(int32(len(docs)), 8))
+
+	vector := docs[0].Vector
+	h.Update(docs[0].Id, data.BuildDoc(0, 8).Vector)
+	if &docs[0].Vector[0] != &vector[0] {
+		t.Fatalf("the inserted doc is modified by Update")
+	}
+	for layer, neighbors := range h.Neighbors[docs[0].Id] {
+		for _, n := range neighbors {
+			if dis := h.DisFunc(h.Docs[docs[0].Id].Vector, n.Doc.Vector); dis != n.Dis {
+				t.Fatalf("stale distance [%v] of link [0] -> [%v] at layer [%v], expect: [%v]", n.Dis, n.Doc.Id, layer, dis)
+			}
+			for _, reverse := range h.Neighbors[n.Doc.Id][layer] {
+				if reverse.Doc.Id == docs[0].Id && reverse.Dis != n.Dis {
+					t.Fatalf("stale distance [%v] of link [%v] -> [0] at layer [%v], expect: [%v]", reverse.Dis, n.Doc.Id, layer, n.Dis)
+				}
+			}
+		}
+	}
+	hit := 0
+	for _, doc := range h.Docs[:len(docs)+1] {
+		res := h.SearchKNN(doc.Vector, 32, 1, 0)
+		if len(res) == 1 && res[0].Id == doc.Id {
+			hit++
+		}
+	}
+	if hit < 1900 {
+		t.Fatalf("self recall after update too low: [%v / %v]", hit, len(docs)+1)
+	}
+}
+
+func TestSearchKNNFiltered(t *testing.T) {
+	docs, h := newTestIndex(t, 2000, nil)
+	for _, mod := range []int32{3, 500} {
+		allow := func(id int32) bool {
+			return id%mod == 0
+		}
+		hit := 0
+		for _, doc := range docs[:100] {
+			res := h.SearchKNNFiltered(doc.Vector, 1, 32, allow)
+			if len(res) != 1 || !allow(res[0].Id) {
+				t.Fatalf("filtered result [%v] is not allowed", res)
+			}
+			nearest := docs[0]
+			for _, d := range docs {
+				if allow(d.Id) && h.DisFunc(doc.Vector, d.Vector) < h.DisFunc(doc.Vector, nearest.Vector) {
+					nearest = d
+				}
+			}
+			if res[0].Id == nearest.Id {
+				hit++
+			}
+		}
+		if hit < 95 {
+			t.Fatalf("filtered self recall too low with mod [%v]: [%v]", mod, hit)
+		}
+	}
+}
+
+func TestSearchRange(t *testing.T) {
+	docs, h := newTestIndex(t, 2000, nil)
+	bf := &brute_force.Searcher{Docs: docs}
+	hitCnt, allCnt := 0, 0
+	for _, doc := range docs[:100] {
+		expect, err := bf.SearchRange(doc.Vector, 0.2, distance.L2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := h.SearchRange(doc.Vector, 0.2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := map[int32]struct{}{}
+		for i, r := range res {
+			if r.Distance != h.DisFunc(doc.Vector, r.Doc.Vector) || r.Distance > 0.2 {
+				t.Fatalf("doc [%v] is out of radius or has a wrong distance: [%v]", r.Doc.Id, r.Distance)
+			}
+			if i > 0 && r.Distance < res[i-1].Distance {
+				t.Fatalf("results are not sorted by distance")
+			}
+			m[r.Doc.Id] = struct{}{}
+		}
+		for _, e := range expect {
+			if _, ok := m[e.Doc.Id]; ok {
+				hitCnt++
+			}
+		}
+		allCnt += len(expect)
+	}
+	if float64(hitCnt) < 0.95*float64(allCnt) {
+		t.Fatalf("range recall too low: [%v / %v]", hitCnt, allCnt)
+	}
+}
+
+func TestSearchKNNWithScore(t *testing.T) {
+	docs, h := newTestIndex(t, 1000, nil)
+	bf := &brute_force.Searcher{Docs: docs}
+	for _, doc := range docs[:10] {
+		hnswRes, err := h.SearchKNNWithScore(doc.Vector, 32, 10, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bfRes, err := bf.QueryWithScore(doc.Vector, 10, distance.L2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, res := range [][]*data.Result{hnswRes, bfRes} {
+			if len(res) != 10 {
+				t.Fatalf("result size: [%v], expect: [10]", len(res))
+			}
+			for i, r := range res {
+				if r.Distance != h.DisFunc(doc.Vector, r.Doc.Vector) || r.Score != distance.L2Score(r.Distance) {
+					t.Fatalf("wrong distance [%v] or score [%v] of doc [%v]", r.Distance, r.Score, r.Doc.Id)
+				}
+				if i > 0 && res[i-1].Distance > r.Distance {
+					t.Fatalf("results are not sorted ascending")
+				}
+			}
+		}
+	}
+}
+
+func TestSearchBatch(t *testing.T) {
+	docs, h := newTestIndex(t, 1000, nil)
+	h.BatchWorkers = 4
+	queries := make([][]float32, 100)
+	for i := range queries {
+		queries[i] = docs[i].Vector
+	}
+	computeCnt := h.ComputeCnt
+	results, stat, err := h.SearchBatch(queries, 10, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.ComputeCnt != h.ComputeCnt-computeCnt || stat.MaxComputeCnt <= 0 {
+		t.Fatalf("wrong batch stat: [%+v]", stat)
+	}
+	for i, res := range results {
+		expect := h.SearchKNN(queries[i], 32, 10, 0)
+		if len(res) != len(expect) {
+			t.Fatalf("result size of query [%v]: [%v], expect: [%v]", i, len(res), len(expect))
+		}
+		for j := range res {
+			if res[j].Doc != expect[j] {
+				t.Fatalf("result of query [%v] differs from SearchKNN", i)
+			}
+		}
+	}
+}
+
+func TestBuildFromDocs(t *testing.T) {
+	docs := data.BuildAllDocWithSeed(8, 2000, 1)
+	progressCnt := 0
+	h, err := BuildFromDocs(docs, BuildOptions{
+		M:       6,
+		EfCons:  32,
+		Mode:    Heuristic,
+		DisType: distance.L2,
+		Seed:    1,
+		Progress: func(inserted int, cost time.Duration) {
+			progressCnt++
+		},
+		ProgressInterval: 500,
+	}, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if progressCnt != 4 {
+		t.Fatalf("progress is reported [%v] times, expect: [4]", progressCnt)
+	}
+	hit := 0
+	for _, doc := range docs {
+		res := h.SearchKNN(doc.Vector, 32, 1, 0)
+		if len(res) == 1 && res[0].Id == doc.Id {
+			hit++
+		}
+	}
+	if hit < 1900 {
+		t.Fatalf("self recall too low: [%v / %v]", hit, len(docs))
+	}
+}
+
+func TestErrors(t *testing.T) {
+	if _, err := NewHNSW(1, 32, Heuristic, distance.L2); !errors.Is(err, util.ErrInvalidParam) {
+		t.Fatalf("unexpected error: [%v]", err)
+	}
+	h, err := NewHNSW(6, 32, Heuristic, distance.L2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = h.Stat(); !errors.Is(err, util.ErrEmptyIndex) {
+		t.Fatalf("unexpected error: [%v]", err)
+	}
+	if _, err = h.SearchKNNWithScore(make([]float32, 8), 32, 10, 0); !errors.Is(err, util.ErrEmptyIndex) {
+		t.Fatalf("unexpected error: [%v]", err)
+	}
+	if err = h.Insert(data.BuildDoc(0, 8)); err != nil {
+		t.Fatal(err)
+	}
+	if err = h.Insert(data.BuildDoc(0, 8)); !errors.Is(err, util.ErrDuplicateId) {
+		t.Fatalf("unexpected error: [%v]", err)
+	}
+	if err = h.Insert(data.BuildDoc(-1, 8)); !errors.Is(err, util.ErrInvalidId) {
+		t.Fatalf("unexpected error: [%v]", err)
+	}
+	if err = h.Insert(data.BuildDoc(1, 4)); !errors.Is(err, util.ErrDimensionMismatch) {
+		t.Fatalf("unexpected error: [%v]", err)
+	}
+	if _, err = h.SearchKNNWithScore(make([]float32, 4), 32, 10, 0); !errors.Is(err, util.ErrDimensionMismatch) {
+		t.Fatalf("unexpected error: [%v]", err)
+	}
+	if res := h.SearchKNN(make([]float32, 4), 32, 10, 0); res != nil {
+		t.Fatalf("unexpected result: [%v]", res)
+	}
+}
+
+func TestKeyIndex(t *testing.T) {
+	h := BuildHNSW(6, 32, Heuristic, distance.L2)
+	h.SetSeed(1)
+	k, err := NewKeyIndex[string](h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	docs := data.BuildAllDocWithSeed(8, 1000, 1)
+	for _, doc := range docs {
+		if err = k.Insert(fmt.Sprintf("sku-%v", doc.Id), doc.Vector); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = k.Insert("sku-1", docs[1].Vector); !errors.Is(err, util.ErrDuplicateKey) {
+		t.Fatalf("unexpected error: [%v]", err)
+	}
+	if err = k.Insert("sku-x", make([]float32, 4)); !errors.Is(err, util.ErrDimensionMismatch) {
+		t.Fatalf("unexpected error: [%v]", err)
+	}
+	if !k.Delete("sku-0") || k.Delete("sku-0") {
+		t.Fatalf("sku-0 should be deleted only once")
+	}
+	// the docs may have reserved slots beyond the keys before compaction
+	buf := &bytes.Buffer{}
+	if err = k.SaveKeys(buf); err != nil {
+		t.Fatal(err)
+	}
+	if loaded, err := LoadKeyIndex[string](h, buf); err != nil {
+		t.Fatal(err)
+	} else if id, ok := loaded.Id("sku-5"); !ok || id != 5 {
+		t.Fatalf("id of sku-5: [%v], ok: [%v]", id, ok)
+	}
+	k.Compact()
+
+	// the keys of results are consistent with their docs while Compact remaps the ids
+	stop := make(chan struct{})
+	wg := sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 1; ; j = j%100 + 1 {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				res, err := k.SearchKNN(docs[j].Vector, 32, 5)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				for _, r := range res {
+					var id int32
+					fmt.Sscanf(r.Key, "sku-%d", &id)
+					if distance.L2Distance(docs[id].Vector, r.Doc.Vector) != 0 {
+						t.Errorf("key [%v] of doc [%v] is wrong", r.Key, r.Doc.Id)
+						return
+					}
+				}
+			}
+		}()
+	}
+	for id := 999; id > 980; id-- {
+		k.Delete(fmt.Sprintf("sku-%v", id))
+		k.Compact()
+	}
+	close(stop)
+	wg.Wait()
+
+	buf.Reset()
+	if err = k.SaveKeys(buf); err != nil {
+		t.Fatal(err)
+	}
+	if k, err = LoadKeyIndex[string](h, buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, doc := range docs[1:100] {
+		res, err := k.SearchKNN(doc.Vector, 32, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key := fmt.Sprintf("sku-%v", doc.Id); len(res) != 1 || res[0].Key != key {
+			t.Fatalf("result of [%v]: [%v]", key, res)
+		}
+	}
+	if _, ok := k.Id("sku-0"); ok {
+		t.Fatalf("deleted key sku-0 is loaded")
+	}
+}
+
+func TestDeterministicBuild(t *testing.T) {
+	build := func() *HNSW {
+		h, err := BuildFromDocs(data.BuildAllDocWithSeed(8, 1000, 42), BuildOptions{
+			M:       6,
+			EfCons:  32,
+			Mode:    Heuristic,
+			DisType: distance.L2,
+			Seed:    7,
+		}, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+	h1, h2 := build(), build()
+	if h1.EntryPoint.Id != h2.EntryPoint.Id || h1.MaxLayer != h2.MaxLayer {
+		t.Fatalf("entry points differ: [%v] vs [%v]", h1.EntryPoint.Id, h2.EntryPoint.Id)
+	}
+	for id := range h1.Neighbors {
+		if len(h1.Neighbors[id]) != len(h2.Neighbors[id]) {
+			t.Fatalf("layer count of doc [%v] differs", id)
+		}
+		for layer := range h1.Neighbors[id] {
+			n1, n2 := h1.Neighbors[id][layer], h2.Neighbors[id][layer]
+			if len(n1) != len(n2) {
+				t.Fatalf("neighbors of doc [%v] at layer [%v] differ", id, layer)
+			}
+			for i := range n1 {
+				if n1[i].Doc.Id != n2[i].Doc.Id || n1[i].Dis != n2[i].Dis {
+					t.Fatalf("neighbors of doc [%v] at layer [%v] differ", id, layer)
+				}
+			}
+		}
+	}
+}
+
+func TestSearchAllocations(t *testing.T) {
+	if raceEnabled {
+		t.Skip("allocations are not stable under the race detector")
+	}
+	docs, h := newTestIndex(t, 1000, nil)
+	h.SearchKNNWithScore(docs[0].Vector, 64, 10, 0)
+	allocs := testing.AllocsPerRun(100, func() {
+		h.SearchKNNWithScore(docs[1].Vector, 64, 10, 0)
+	})
+	// the result slice and 10 results
+	if allocs > 11 {
+		t.Fatalf("allocations per search: [%v]", allocs)
+	}
+}
+
+func TestFlatten(t *testing.T) {
+	docs, h := newTestIndex(t, 2000, nil)
+	h.Delete(docs[0].Id)
+	f, err := h.Flatten()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, doc := range docs[:100] {
+		expect := h.SearchKNN(doc.Vector, 32, 10, 0)
+		res := f.SearchKNN(doc.Vector, 32, 10, 0)
+		if len(res) != len(expect) {
+			t.Fatalf("result size: [%v], expect: [%v]", len(res), len(expect))
+		}
+		for i := range res {
+			if res[i].Id != expect[i].Id {
+				t.Fatalf("result of flat index differs from HNSW")
+			}
+		}
+	}
+
+	// ef is defaulted and raised to k like HNSW
+	for _, ef := range []int32{0, 2} {
+		res, err := f.SearchKNNWithScore(docs[1].Vector, ef, 10, 0)
+		if err != nil || len(res) != 10 {
+			t.Fatalf("ef: [%v], result size: [%v], err: [%v]", ef, len(res), err)
+		}
+	}
+	if _, err = f.SearchKNNWithScore(docs[1].Vector, 32, 0, 0); !errors.Is(err, util.ErrInvalidParam) {
+		t.Fatalf("unexpected error: [%v]", err)
+	}
+	if f.cap0 != h.M0 || f.capUpper != h.M {
+		t.Fatalf("block capacity: [%v, %v], expect: [%v, %v]", f.cap0, f.capUpper, h.M0, h.M)
+	}
+}
+
+func TestHeuristicOptions(t *testing.T) {
+	docs := data.BuildAllDocWithSeed(8, 2000, 1)
+	// average count of neighbors at layer 0
+	degrees := map[string]float64{}
+	for name, opts := range map[string]HeuristicOptions{
+		"default":  DefaultHeuristicOptions(),
+		"extend":   {ExtendCandidates: true, KeepPrunedConnections: true, Alpha: 1},
+		"no_keep":  {Alpha: 1},
+		"alpha":    {Alpha: 1.5},
+		"all":      {ExtendCandidates: true, KeepPrunedConnections: true, Alpha: 1.2},
+		"zero_opt": {},
+	} {
+		h, err := BuildFromDocs(docs, BuildOptions{
+			M:         6,
+			EfCons:    32,
+			Mode:      Heuristic,
+			DisType:   distance.L2,
+			Seed:      1,
+			Heuristic: &opts,
+		}, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		edgeCnt := 0
+		for _, layers := range h.Neighbors {
+			edgeCnt += len(layers[0])
+			for layer, neighbors := range layers {
+				if int32(len(neighbors)) > h.getMaxNeighborCnt(int32(layer)) {
+					t.Fatalf("[%v] has [%v] neighbors at layer [%v]", name, len(neighbors), layer)
+				}
+			}
+		}
+		degrees[name] = float64(edgeCnt) / float64(len(docs))
+		hit := 0
+		for _, doc := range docs {
+			res := h.SearchKNN(doc.Vector, 32, 1, 0)
+			if len(res) == 1 && res[0].Id == doc.Id {
+				hit++
+			}
+		}
+		if hit < 1900 {
+			t.Fatalf("[%v] self recall too low: [%v / %v]", name, hit, len(docs))
+		}
+	}
+	if degrees["no_keep"] >= degrees["default"] {
+		t.Fatalf("pruned connections are kept, degree: [%v] >= [%v]", degrees["no_keep"], degrees["default"])
+	}
+	if degrees["alpha"] <= degrees["no_keep"] {
+		t.Fatalf("alpha does not relax the pruning, degree: [%v] <= [%v]", degrees["alpha"], degrees["no_keep"])
+	}
+	if degrees["zero_opt"] != degrees["no_keep"] {
+		t.Fatalf("alpha 0 should be 1, degree: [%v] != [%v]", degrees["zero_opt"], degrees["no_keep"])
+	}
+}
+
+func TestSearchKNNWithStats(t *testing.T) {
+	docs, h := newTestIndex(t, 2000, nil)
+	expect := make([]*data.SearchStats, 100)
+	for i := range expect {
+		res, stats, err := h.SearchKNNWithStats(docs[i].Vector, 32, 10, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		scoreRes, _ := h.SearchKNNWithScore(docs[i].Vector, 32, 10, 0)
+		if fmt.Sprint(data.ResultDocs(res)) != fmt.Sprint(data.ResultDocs(scoreRes)) {
+			t.Fatalf("results differ from SearchKNNWithScore")
+		}
+		if len(stats.VisitedCnt) != int(h.MaxLayer+1) {
+			t.Fatalf("visited count of [%v] layers, expect: [%v]", len(stats.VisitedCnt), h.MaxLayer+1)
+		}
+		visitedCnt := int64(0)
+		for _, cnt := range stats.VisitedCnt {
+			visitedCnt += cnt
+		}
+		if stats.ComputeCnt != visitedCnt || stats.HopCnt == 0 || stats.HeapOpCnt == 0 {
+			t.Fatalf("unexpected stats: [%+v]", stats)
+		}
+		expect[i] = stats
+	}
+	_, stats, _ := h.SearchKNNWithStats(docs[0].Vector, 32, 10, 1)
+	if len(stats.VisitedCnt) != 1 {
+		t.Fatalf("upper layers are visited with ignoreLayer")
+	}
+
+	// stats of concurrent searches are not mixed up
+	wg := sync.WaitGroup{}
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range expect {
+				_, stats, _ := h.SearchKNNWithStats(docs[i].Vector, 32, 10, 0)
+				if stats.ComputeCnt != expect[i].ComputeCnt || stats.HeapOpCnt != expect[i].HeapOpCnt {
+					t.Errorf("stats of query [%v] differ: [%+v] != [%+v]", i, stats, expect[i])
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestSearch(t *testing.T) {
+	docs, h := newTestIndex(t, 2000, nil)
+	h.Ef = 32
+	hit := 0
+	for i, doc := range docs[:200] {
+		res, stats, err := h.Search(doc.Vector, SearchOptions{K: 1, EntryPoint: EntryPointGiven, EntryPointId: int32(i * 7)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats != nil {
+			t.Fatalf("stats are returned without CollectStats")
+		}
+		if len(res) == 1 && res[0].Doc.Id == doc.Id {
+			hit++
+		}
+	}
+	if hit < 190 {
+		t.Fatalf("self recall from given entry points too low: [%v / 200]", hit)
+	}
+
+	// the default ef is h.Ef
+	res, _, _ := h.Search(docs[0].Vector, SearchOptions{K: 10})
+	expect := h.SearchKNN(docs[0].Vector, 32, 10, 0)
+	if fmt.Sprint(data.ResultDocs(res)) != fmt.Sprint(expect) {
+		t.Fatalf("results with the default ef differ from ef [%v]", h.Ef)
+	}
+
+	allow := func(id int32) bool { return id%3 == 0 }
+	res, _, _ = h.Search(docs[0].Vector, SearchOptions{K: 10, Ef: 64, Filter: allow})
+	if fmt.Sprint(data.ResultDocs(res)) != fmt.Sprint(h.SearchKNNFiltered(docs[0].Vector, 10, 64, allow)) {
+		t.Fatalf("filtered results differ from SearchKNNFiltered")
+	}
+
+	_, full, _ := h.Search(docs[0].Vector, SearchOptions{K: 10, Ef: 1000, CollectStats: true})
+	res, stats, err := h.Search(docs[0].Vector, SearchOptions{K: 10, Ef: 1000, TimeBudget: time.Nanosecond,
+		CollectStats: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stats.TimedOut || len(res) == 0 || stats.ComputeCnt >= full.ComputeCnt {
+		t.Fatalf("time budget is not applied, stats: [%+v], full search: [%+v]", stats, full)
+	}
+	if full.TimedOut {
+		t.Fatalf("search without time budget timed out")
+	}
+
+	for _, opts := range []SearchOptions{
+		{K: 0},
+		{K: 10, EntryPoint: EntryPointGiven, EntryPointId: 2000},
+		{K: 10, EntryPoint: 3},
+	} {
+		if _, _, err = h.Search(docs[0].Vector, opts); err == nil {
+			t.Fatalf("no error with options: [%+v]", opts)
+		}
+	}
+}
+
+func TestTuneEf(t *testing.T) {
+	_, h := newTestIndex(t, 2000, nil)
+	queries := [][]float32{}
+	for _, doc := range data.BuildAllDocWithSeed(8, 50, 2) {
+		queries = append(queries, doc.Vector)
+	}
+	ef, err := h.TuneEf(queries, 10, 0.98)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ef != h.Ef || ef < 10 {
+		t.Fatalf("unexpected ef: [%v], h.Ef: [%v]", ef, h.Ef)
+	}
+	for i, point := range h.EfCurve {
+		if i > 0 && point.Ef <= h.EfCurve[i-1].Ef {
+			t.Fatalf("curve is not sorted by ef: [%+v]", h.EfCurve)
+		}
+		if point.Ef == ef && point.Recall < 0.98 {
+			t.Fatalf("recall of the tuned ef is too low: [%+v]", point)
+		}
+		if point.Ef == ef-1 && point.Recall >= 0.98 {
+			t.Fatalf("ef [%v] is not the smallest one: [%+v]", ef, h.EfCurve)
+		}
+	}
+
+	for _, c := range []struct {
+		queries      [][]float32
+		k            int32
+		targetRecall float64
+	}{
+		{nil, 10, 0.9},
+		{queries, 0, 0.9},
+		{queries, 10, 1.5},
+	} {
+		if _, err = h.TuneEf(c.queries, c.k, c.targetRecall); !errors.Is(err, util.ErrInvalidParam) {
+			t.Fatalf("unexpected error: [%v]", err)
+		}
+	}
+}
+
+func TestMultiIndex(t *testing.T) {
+	h := BuildHNSW(6, 32, Heuristic, distance.L2)
+	h.SetSeed(1)
+	m, err := NewMultiIndex(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vectors := data.BuildAllDocWithSeed(8, 3000, 1)
+	docs := []*data.MultiDoc{}
+	for i := 0; i < 1000; i++ {
+		doc := &data.MultiDoc{Id: int32(10 * i)}
+		for _, v := range vectors[3*i : 3*i+3] {
+			doc.Vectors = append(doc.Vectors, v.Vector)
+		}
+		docs = append(docs, doc)
+		if err = m.Insert(doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = m.Insert(docs[0]); !errors.Is(err, util.ErrDuplicateId) {
+		t.Fatalf("unexpected error of duplicate doc: [%v]", err)
+	}
+	if !m.Delete(docs[1].Id) || m.Delete(docs[1].Id) {
+		t.Fatalf("unexpected result of Delete")
+	}
+
+	hit := 0
+	for i, doc := range docs {
+		res, err := m.Search(doc.Vectors[i%3], 10, 64, MaxSim, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parents := map[int32]struct{}{}
+		for j, r := range res {
+			if _, ok := parents[r.ParentId]; ok {
+				t.Fatalf("doc [%v] is returned twice", r.ParentId)
+			}
+			parents[r.ParentId] = struct{}{}
+			if r.ParentId == docs[1].Id {
+				t.Fatalf("deleted doc is returned")
+			}
+			if parentId, _ := m.ParentId(r.Doc.Id); parentId != r.ParentId {
+				t.Fatalf("best vector [%v] does not belong to doc [%v]", r.Doc.Id, r.ParentId)
+			}
+			if j > 0 && r.Distance < res[j-1].Distance {
+				t.Fatalf("results are not ranked by the best matching vector")
+			}
+		}
+		if len(res) > 0 && res[0].ParentId == doc.Id {
+			hit++
+		}
+	}
+	// the query of the deleted doc can not hit
+	if hit < 995 {
+		t.Fatalf("self recall too low: [%v / 1000]", hit)
+	}
+
+	// sum of top 2 scores computed by brute force
+	query := docs[5].Vectors[0]
+	res, err := m.Search(query, 5, 64, SumTopN, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range res {
+		scores := []float32{}
+		for _, v := range docs[r.ParentId/10].Vectors {
+			scores = append(scores, distance.L2Score(distance.L2Distance(query, v)))
+		}
+		sort.Slice(scores, func(i, j int) bool { return scores[i] > scores[j] })
+		if expect := scores[0] + scores[1]; math.Abs(float64(expect-r.Score)) > 1e-5 {
+			t.Fatalf("score of doc [%v]: [%v], expect: [%v]", r.ParentId, r.Score, expect)
+		}
+	}
+	if res[0].ParentId != docs[5].Id {
+		t.Fatalf("doc of the query is not ranked first: [%v]", res[0].ParentId)
+	}
+
+	// the docs may have reserved slots beyond the parents before compaction
+	buf := &bytes.Buffer{}
+	if err = m.SaveParents(buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = LoadMultiIndex(m.HNSW, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	m.Compact()
+	buf.Reset()
+	if err = m.SaveParents(buf); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadMultiIndex(m.HNSW, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err = loaded.Search(docs[7].Vectors[1], 1, 64, MaxSim, 0)
+	if err != nil || len(res) != 1 || res[0].ParentId != docs[7].Id {
+		t.Fatalf("unexpected result after compaction and reloading: [%v], err: [%v]", res, err)
+	}
+}
+
+func TestMultiIndexRecall(t *testing.T) {
+	h := BuildHNSW(6, 32, Heuristic, distance.L2)
+	h.SetSeed(1)
+	m, err := NewMultiIndex(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// many vectors per doc, so that the first vector reached is often not the best one of its doc
+	vectors := data.BuildAllDocWithSeed(8, 10000, 1)
+	for i := 0; i < 1000; i++ {
+		doc := &data.MultiDoc{Id: int32(i)}
+		for _, v := range vectors[10*i : 10*i+10] {
+			doc.Vectors = append(doc.Vectors, v.Vector)
+		}
+		if err = m.Insert(doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hit := 0
+	for _, query := range data.BuildAllDocWithSeed(8, 50, 2) {
+		// MaxSim of every doc by brute force
+		best := make([]float32, 1000)
+		for i := range best {
+			best[i] = float32(math.MaxFloat32)
+			for _, v := range vectors[10*i : 10*i+10] {
+				best[i] = min(best[i], distance.L2Distance(query.Vector, v.Vector))
+			}
+		}
+		sorted := append([]float32{}, best...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		res, err := m.Search(query.Vector, 10, 64, MaxSim, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range res {
+			if best[r.ParentId] <= sorted[9] {
+				hit++
+			}
+		}
+	}
+	if hit < 495 {
+		t.Fatalf("recall too low: [%v / 500]", hit)
+	}
+}
+
+func TestPayload(t *testing.T) {
+	docs := data.BuildAllDocWithSeed(8, 1000, 1)
+	h := BuildHNSW(6, 32, Heuristic, distance.L2)
+	h.SetSeed(1)
+	for _, doc := range docs {
+		doc.Payload = []byte(fmt.Sprintf("title-%v", doc.Id))
+		if err := h.Insert(doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(name string, results []*data.Doc) {
+		for _, doc := range results {
+			if expect := fmt.Sprintf("title-%v", doc.Id); string(doc.Payload) != expect {
+				t.Fatalf("[%v] payload of doc [%v]: [%s], expect: [%v]", name, doc.Id, doc.Payload, expect)
+			}
+		}
+	}
+	check("search", h.SearchKNN(docs[0].Vector, 32, 10, 0))
+	flat, err := h.Flatten()
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("flat", flat.SearchKNN(docs[0].Vector, 32, 10, 0))
+	h.Delete(0)
+	h.Compact()
+	for _, doc := range h.SearchKNN(docs[1].Vector, 32, 10, 0) {
+		// ids are renumbered by compaction
+		if expect := fmt.Sprintf("title-%v", doc.Id+1); string(doc.Payload) != expect {
+			t.Fatalf("payload of doc [%v] after compaction: [%s], expect: [%v]", doc.Id, doc.Payload, expect)
+		}
+	}
+	if err = h.Upsert(&data.Doc{Id: 5, Vector: docs[6].Vector, Payload: []byte("new")}); err != nil {
+		t.Fatal(err)
+	}
+	if res := h.SearchKNN(docs[6].Vector, 32, 1, 0); string(res[0].Payload) != "new" {
+		t.Fatalf("payload is not replaced by Upsert: [%s]", res[0].Payload)
+	}
+
+	k, err := NewKeyIndex[string](BuildHNSW(6, 32, Heuristic, distance.L2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = k.InsertWithPayload("sku", docs[0].Vector, []byte("url")); err != nil {
+		t.Fatal(err)
+	}
+	if res, _ := k.SearchKNN(docs[0].Vector, 32, 1); len(res) != 1 || string(res[0].Doc.Payload) != "url" {
+		t.Fatalf("payload is not returned by KeyIndex")
+	}
+}
+
+func TestSimilarityDistances(t *testing.T) {
+	queries := data.BuildAllDocWithSeed(8, 50, 2)
+	for _, c := range []struct {
+		disType   distance.Type
+		normalize bool
+	}{
+		{distance.Cosine, false},
+		{distance.Cosine, true},
+		{distance.InnerProduct, false},
+	} {
+		docs, h := newTestIndex(t, 2000, &BuildOptions{
+			M:         6,
+			EfCons:    32,
+			Mode:      Heuristic,
+			DisType:   c.disType,
+			Normalize: c.normalize,
+		})
+		bf := &brute_force.Searcher{Docs: data.BuildAllDocWithSeed(8, 2000, 1)}
+		if docs[0].Vector[0] != bf.Docs[0].Vector[0] {
+			t.Fatalf("[%v] inserted docs are normalized in place", c.disType)
+		}
+		hit := 0
+		for _, query := range queries {
+			truth, err := bf.QueryWithScore(query.Vector, 10, c.disType)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res, err := h.SearchKNNWithScore(query.Vector, 64, 10, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids := map[int32]struct{}{}
+			for _, r := range truth {
+				ids[r.Doc.Id] = struct{}{}
+			}
+			for i, r := range res {
+				if _, ok := ids[r.Doc.Id]; ok {
+					hit++
+				}
+				if i > 0 && r.Score > res[i-1].Score {
+					t.Fatalf("[%+v] results are not ranked by score", c)
+				}
+			}
+			if math.Abs(float64(res[0].Score-truth[0].Score)) > 1e-5 {
+				t.Fatalf("[%+v] best score: [%v], expect: [%v]", c, res[0].Score, truth[0].Score)
+			}
+		}
+		if hit < 450 {
+			t.Fatalf("[%+v] recall too low: [%v / 500]", c, hit)
+		}
+	}
+	if err := BuildHNSW(6, 32, Heuristic, distance.L2).SetNormalize(true); !errors.Is(err, util.ErrInvalidParam) {
+		t.Fatalf("unexpected error of normalizing for L2: [%v]", err)
+	}
+	// vectors already inserted would not match the distance function
+	_, h := newTestIndex(t, 100, &BuildOptions{M: 6, EfCons: 32, Mode: Heuristic, DisType: distance.Cosine})
+	if err := h.SetNormalize(true); !errors.Is(err, util.ErrInvalidParam) || h.Normalize {
+		t.Fatalf("normalization is changed after insertion: [%v]", err)
+	}
+}
+
+func TestBoundedDistance(t *testing.T) {
+	// dimensions of several blocks, so that far neighbors are abandoned early
+	docs := data.BuildAllDocWithSeed(200, 1000, 1)
+	queries := data.BuildAllDocWithSeed(200, 50, 2)
+	bounded, unbounded := BuildHNSW(6, 32, Heuristic, distance.L2), BuildHNSW(6, 32, Heuristic, distance.L2)
+	unbounded.BoundedDisFunc = distance.Unbounded(distance.L2Distance)
+	for _, h := range []*HNSW{bounded, unbounded} {
+		h.SetSeed(1)
+		for _, doc := range docs {
+			if err := h.Insert(doc); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// the bounded distances do not change any decision of insertions and searches
+	for id := range docs {
+		for layer := range bounded.Neighbors[id] {
+			if len(bounded.Neighbors[id][layer]) != len(unbounded.Neighbors[id][layer]) {
+				t.Fatalf("neighbors of doc [%v] at layer [%v] differ", id, layer)
+			}
+			for i, n := range bounded.Neighbors[id][layer] {
+				if n.Doc.Id != unbounded.Neighbors[id][layer][i].Doc.Id {
+					t.Fatalf("neighbors of doc [%v] at layer [%v] differ", id, layer)
+				}
+			}
+		}
+	}
+	bf := &brute_force.Searcher{Docs: docs}
+	hit := 0
+	for _, query := range queries {
+		res, err := bounded.SearchKNNWithScore(query.Vector, 128, 10, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expect, err := unbounded.SearchKNNWithScore(query.Vector, 128, 10, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		truth, err := bf.QueryWithScore(query.Vector, 10, distance.L2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := map[int32]struct{}{}
+		for _, r := range truth {
+			ids[r.Doc.Id] = struct{}{}
+			if r.Distance != distance.L2Distance(query.Vector, r.Doc.Vector) {
+				t.Fatalf("brute force distance of doc [%v] is not exact: [%v]", r.Doc.Id, r.Distance)
+			}
+		}
+		for i, r := range res {
+			if r.Doc.Id != expect[i].Doc.Id || r.Distance != expect[i].Distance {
+				t.Fatalf("result [%v]: [%v %v], expect: [%v %v]", i, r.Doc.Id, r.Distance, expect[i].Doc.Id,
+					expect[i].Distance)
+			}
+			if _, ok := ids[r.Doc.Id]; ok {
+				hit++
+			}
+		}
+	}
+	if hit < 400 {
+		t.Fatalf("recall too low: [%v / 500]", hit)
+	}
+}
+
+// the cosine similarity as a custom distance, registered once per test binary
+var unitDot, errRegisterUnitDot = distance.Register("unit_dot", func(vec1, vec2 []float32) float32 {
+	return -distance.InnerProductDistance(vec1, vec2)
+}, distance.Properties{IsSimilarity: true, RequiresNormalization: true})
+
+func TestCustomDistance(t *testing.T) {
+	if errRegisterUnitDot != nil {
+		t.Fatal(errRegisterUnitDot)
+	}
+	_, h := newTestIndex(t, 2000, &BuildOptions{M: 6, EfCons: 32, Mode: Heuristic, DisType: unitDot})
+	queries := data.BuildAllDocWithSeed(8, 50, 2)
+	bf := &brute_force.Searcher{Docs: data.BuildAllDocWithSeed(8, 2000, 1)}
+	// the distance requires normalization, even though it is not asked for
+	if !h.Normalize {
+		t.Fatalf("vectors of [%v] are not normalized", unitDot)
+	}
+	if err := h.SetNormalize(false); !errors.Is(err, util.ErrInvalidParam) || !h.Normalize {
+		t.Fatalf("normalization of [%v] is turned off: [%v]", unitDot, err)
+	}
+	hit := 0
+	for _, query := range queries {
+		truth, err := bf.QueryWithScore(query.Vector, 10, unitDot)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := h.SearchKNNWithScore(query.Vector, 64, 10, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := map[int32]struct{}{}
+		for _, r := range truth {
+			ids[r.Doc.Id] = struct{}{}
+		}
+		for _, r := range res {
+			if _, ok := ids[r.Doc.Id]; ok {
+				hit++
+			}
+		}
+		// scores are the similarities
+		cos := distance.CosineScore(distance.CosineDistance(query.Vector, res[0].Doc.Vector))
+		if math.Abs(float64(res[0].Score-cos)) > 1e-5 {
+			t.Fatalf("best score: [%v], expect: [%v]", res[0].Score, cos)
+		}
+	}
+	if hit < 450 {
+		t.Fatalf("recall too low: [%v / 500]", hit)
+	}
+}
+
+func TestBinaryVectors(t *testing.T) {
+	// 256-bit codes around 20 centers, so that the nearest codes are not ties of random codes
+	r := rand.New(rand.NewSource(1))
+	centers := make([]distance.BinaryVector, 20)
+	for i := range centers {
+		centers[i] = distance.BinaryVector{r.Uint64(), r.Uint64(), r.Uint64(), r.Uint64()}
+	}
+	buildCodes := func(count int) []*data.Doc {
+		docs := make([]*data.Doc, count)
+		for i := range docs {
+			code := append(distance.BinaryVector{}, centers[r.Intn(len(centers))]...)
+			for j := 0; j < 32; j++ {
+				bit := r.Intn(256)
+				code[bit/64] ^= 1 << (bit % 64)
+			}
+			docs[i] = &data.Doc{Id: int32(i), Vector: code.Pack()}
+		}
+		return docs
+	}
+	docs, queries := buildCodes(2000), buildCodes(50)
+	// 32 bits per word instead of one float32 per bit
+	if len(docs[0].Vector) != 256/32 {
+		t.Fatalf("words of a 256-bit code: [%v]", len(docs[0].Vector))
+	}
+	// the clusters are far apart, more links keep them connected
+	h, err := BuildFromDocs(docs, BuildOptions{M: 12, EfCons: 64, Mode: Heuristic, DisType: distance.Hamming, Seed: 1}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bf := &brute_force.Searcher{Docs: docs}
+	hit := 0
+	for _, query := range queries {
+		truth, err := bf.QueryWithScore(query.Vector, 10, distance.Hamming)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := h.SearchKNNWithScore(query.Vector, 64, 10, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// compare by distance, since codes at the same distance are interchangeable
+		for i, r := range res {
+			if r.Distance <= truth[len(truth)-1].Distance {
+				hit++
+			}
+			if i > 0 && r.Distance < res[i-1].Distance {
+				t.Fatalf("results are not ranked by distance")
+			}
+		}
+		if res[0].Distance != truth[0].Distance || res[0].Distance != distance.HammingDistance(query.Vector,
+			res[0].Doc.Vector) {
+			t.Fatalf("nearest distance: [%v], expect: [%v]", res[0].Distance, truth[0].Distance)
+		}
+	}
+	if hit < 450 {
+		t.Fatalf("recall too low: [%v / 500]", hit)
+	}
+}
+
+func TestSaveLoad(t *testing.T) {
+	docs := data.BuildAllDocWithSeed(8, 1000, 1)
+	h := BuildHNSW(6, 32, Heuristic, distance.L2)
+	h.SetSeed(1)
+	// every 10th slot is left empty
+	for _, doc := range docs {
+		if doc.Id%10 == 0 {
+			continue
+		}
+		doc.Payload = []byte(fmt.Sprintf("title-%v", doc.Id))
+		if err := h.Insert(doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h.Delete(1)
+	buf := &bytes.Buffer{}
+	if err := h.Save(buf); err != nil {
+		t.Fatal(err)
+	}
+	size := buf.Len()
+	loaded, err := Load(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.Docs) != len(h.Docs) || loaded.Docs[0] != nil || !loaded.Deleted[1] ||
+		loaded.DisType != h.DisType || loaded.HeuristicOptions != h.HeuristicOptions {
+		t.Fatalf("loaded index differs from the saved one")
+	}
+	for _, doc := range docs[:100] {
+		expect, res := h.SearchKNN(doc.Vector, 32, 10, 0), loaded.SearchKNN(doc.Vector, 32, 10, 0)
+		if len(res) != len(expect) {
+			t.Fatalf("result size of doc [%v]: [%v], expect: [%v]", doc.Id, len(res), len(expect))
+		}
+		for i, r := range res {
+			if r.Id != expect[i].Id || string(r.Payload) != string(expect[i].Payload) {
+				t.Fatalf("result of doc [%v]: [%v], expect: [%v]", doc.Id, r.Id, expect[i].Id)
+			}
+		}
+	}
+	if err = loaded.Insert(docs[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = BuildHNSW(6, 32, Heuristic, distance.L2).Save(buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Load(bytes.NewReader(buf.Bytes()[:size-1])); !errors.Is(err, util.ErrCorruptFile) {
+		t.Fatalf("truncated data should be corrupt, err: [%v]", err)
+	}
+	// Load stops at the end of the first index
+	reader := bytes.NewReader(buf.Bytes())
+	if _, err = Load(reader); err != nil {
+		t.Fatal(err)
+	}
+	if empty, err := Load(reader); err != nil || len(empty.Docs) != 0 || empty.EntryPoint != nil {
+		t.Fatalf("unexpected empty index: [%v], err: [%v]", empty, err)
+	}
+}
+
+func TestSaveLoadAfterDeletingEntryPoint(t *testing.T) {
+	docs, h := newTestIndex(t, 500, nil)
+	// the deleted entry points keep their layers above the new max layer
+	maxLayer := h.MaxLayer
+	for h.MaxLayer == maxLayer {
+		h.Delete(h.EntryPoint.Id)
+	}
+	buf := &bytes.Buffer{}
+	if err := h.Save(buf); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := Load(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.MaxLayer != h.MaxLayer || loaded.EntryPoint.Id != h.EntryPoint.Id {
+		t.Fatalf("entry point of the loaded index: [%v] at layer [%v], expect: [%v] at layer [%v]",
+			loaded.EntryPoint.Id, loaded.MaxLayer, h.EntryPoint.Id, h.MaxLayer)
+	}
+	for _, doc := range docs[:50] {
+		expect, res := h.SearchKNN(doc.Vector, 32, 10, 0), loaded.SearchKNN(doc.Vector, 32, 10, 0)
+		if len(res) != len(expect) {
+			t.Fatalf("result size of doc [%v]: [%v], expect: [%v]", doc.Id, len(res), len(expect))
+		}
+		for i, r := range res {
+			if r.Id != expect[i].Id {
+				t.Fatalf("result of doc [%v]: [%v], expect: [%v]", doc.Id, r.Id, expect[i].Id)
+			}
+		}
+	}
+}
+
+// docs whose first element is slowMark make slowL2 sleep
+const slowMark = 1000
+
+// slowL2 is the L2 distance which sleeps for the docs marked by slowMark, or for all docs while slowAll is
+// set. It records the max number of its calls in flight, registered once per test binary
+var (
+	slowAll                       atomic.Bool
+	slowInFlight, slowMaxInFlight atomic.Int64
+	slowL2, errRegisterSlowL2     = distance.Register("slow_l2", func(vec1, vec2 []float32) float32 {
+		if slowAll.Load() || vec1[0] == slowMark || vec2[0] == slowMark {
+			n := slowInFlight.Add(1)
+			for max := slowMaxInFlight.Load(); n > max && !slowMaxInFlight.CompareAndSwap(max, n); {
+				max = slowMaxInFlight.Load()
+			}
+			time.Sleep(200 * time.Microsecond)
+			slowInFlight.Add(-1)
+		}
+		return distance.L2Distance(vec1, vec2)
+	}, distance.Properties{})
+)
+
+func TestParallelBuildOverlap(t *testing.T) {
+	if errRegisterSlowL2 != nil {
+		t.Fatal(errRegisterSlowL2)
+	}
+	slowAll.Store(true)
+	defer slowAll.Store(false)
+	slowMaxInFlight.Store(0)
+	docs := data.BuildAllDocWithSeed(8, 50, 1)
+	if _, err := BuildFromDocs(docs, BuildOptions{M: 6, EfCons: 16, Mode: Heuristic, DisType: slowL2}, 8); err != nil {
+		t.Fatal(err)
+	}
+	// the insertions of the workers compute distances at the same time
+	if max := slowMaxInFlight.Load(); max < 2 {
+		t.Fatalf("max distance computations in flight: [%v], the insertions are serialized", max)
+	}
+}
+
+func TestSearchDuringSlowInsert(t *testing.T) {
+	if errRegisterSlowL2 != nil {
+		t.Fatal(errRegisterSlowL2)
+	}
+	docs, h := newTestIndex(t, 500, &BuildOptions{M: 6, EfCons: 32, Mode: Heuristic, DisType: slowL2})
+	slowDoc := data.BuildDoc(500, 8)
+	slowDoc.Vector[0] = slowMark
+	var slowDone atomic.Bool
+	go func() {
+		if err := h.Insert(slowDoc); err != nil {
+			t.Error(err)
+		}
+		slowDone.Store(true)
+	}()
+	for slowInFlight.Load() == 0 && !slowDone.Load() {
+		time.Sleep(100 * time.Microsecond)
+	}
+	// another insertion waits for nothing but the slots, and does not block the searches
+	go func() {
+		if err := h.Insert(data.BuildDoc(501, 8)); err != nil {
+			t.Error(err)
+		}
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if res := h.SearchKNN(docs[0].Vector, 32, 1, 0); len(res) != 1 || res[0].Id != docs[0].Id {
+		t.Fatalf("unexpected result: [%v]", res)
+	}
+	if slowDone.Load() {
+		t.Fatalf("the search waited for the slow insertion")
+	}
+	for !slowDone.Load() {
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,219 @@
+package hnsw
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/shiyinong/hnsw-go/data"
+	"github.com/shiyinong/hnsw-go/util"
+)
+
+// Key is the type of external keys of a KeyIndex.
+type Key interface {
+	string | uint64
+}
+
+// KeyIndex maps arbitrary external keys to the dense internal ids of an HNSW. All docs of the HNSW should be
+// inserted through the KeyIndex.
+type KeyIndex[K Key] struct {
+	HNSW *HNSW
+
+	// held for reading during Insert, for writing by Compact
+	maintainLock sync.RWMutex
+	// guards keys, ids and dim
+	lock sync.RWMutex
+	// internal id -> key
+	keys []K
+	// key -> internal id, deleted keys are removed
+	ids map[K]int32
+	dim int
+}
+
+type KeyResult[K Key] struct {
+	Key K
+	data.Result
+}
+
+// NewKeyIndex wraps an empty HNSW.
+func NewKeyIndex[K Key](h *HNSW) (*KeyIndex[K], error) {
+	h.initOnce.Do(h.initLocks)
+	h.globalLock.RLock()
+	defer h.globalLock.RUnlock()
+	if len(h.Docs) > 0 {
+		return nil, fmt.Errorf("%w: index is not empty", util.ErrInvalidParam)
+	}
+	return &KeyIndex[K]{
+		HNSW: h,
+		ids:  make(map[K]int32),
+	}, nil
+}
+
+// Insert assigns the next internal id to key and inserts vector into the index.
+func (k *KeyIndex[K]) Insert(key K, vector []float32) error {
+	return k.InsertWithPayload(key, vector, nil)
+}
+
+// InsertWithPayload is like Insert, and payload is attached to the doc, see data.Doc.Payload.
+func (k *KeyIndex[K]) InsertWithPayload(key K, vector []float32, payload []byte) error {
+	k.maintainLock.RLock()
+	defer k.maintainLock.RUnlock()
+	k.lock.Lock()
+	if _, ok := k.ids[key]; ok {
+		k.lock.Unlock()
+		return fmt.Errorf("%w: [%v]", util.ErrDuplicateKey, key)
+	}
+	if k.dim > 0 && k.dim != len(vector) {
+		k.lock.Unlock()
+		return fmt.Errorf("%w: index dim: [%v] != doc dim: [%v]", util.ErrDimensionMismatch, k.dim, len(vector))
+	}
+	id := int32(len(k.keys))
+	k.keys = append(k.keys, key)
+	k.ids[key] = id
+	k.dim = len(vector)
+	k.lock.Unlock()
+
+	if err := k.HNSW.Insert(&data.Doc{Id: id, Vector: vector, Payload: payload}); err != nil {
+		// the id is not reused, the hole is removed by Compact
+		k.lock.Lock()
+		delete(k.ids, key)
+		k.lock.Unlock()
+		return err
+	}
+	return nil
+}
+
+// Delete deletes the doc of key, it returns false if key does not exist.
+func (k *KeyIndex[K]) Delete(key K) bool {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	id, ok := k.ids[key]
+	if !ok {
+		return false
+	}
+	delete(k.ids, key)
+	return k.HNSW.Delete(id)
+}
+
+// Update replaces the vector of key, it returns false if key does not exist or vector has a wrong dimension.
+func (k *KeyIndex[K]) Update(key K, vector []float32) bool {
+	// held across the update, so that Compact can not remap the id of key in between
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	id, ok := k.ids[key]
+	return ok && k.HNSW.Update(id, vector)
+}
+
+// Id returns the internal id of key.
+func (k *KeyIndex[K]) Id(key K) (int32, bool) {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	id, ok := k.ids[key]
+	return id, ok
+}
+
+// Key returns the key of internal id.
+func (k *KeyIndex[K]) Key(id int32) (K, bool) {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	if id < 0 || int(id) >= len(k.keys) {
+		var key K
+		return key, false
+	}
+	return k.keys[id], true
+}
+
+// SearchKNN is like HNSW.SearchKNNWithScore, but the keys of docs are returned along with the results.
+func (k *KeyIndex[K]) SearchKNN(query []float32, ef, topK int32) ([]*KeyResult[K], error) {
+	// held across the search, so that Compact can not remap the ids of the results
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	results, err := k.HNSW.SearchKNNWithScore(query, ef, topK, 0)
+	if err != nil {
+		return nil, err
+	}
+	keyResults := make([]*KeyResult[K], len(results))
+	for i, r := range results {
+		keyResults[i] = &KeyResult[K]{
+			Key:    k.keys[r.Doc.Id],
+			Result: *r,
+		}
+	}
+	return keyResults, nil
+}
+
+// Compact is like HNSW.Compact, and the keys are remapped to the new internal ids.
+func (k *KeyIndex[K]) Compact() []int32 {
+	k.maintainLock.Lock()
+	defer k.maintainLock.Unlock()
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	mapping := k.HNSW.Compact()
+	keys := make([]K, len(k.HNSW.Docs))
+	for oldId, newId := range mapping {
+		if newId < 0 {
+			continue
+		}
+		keys[newId] = k.keys[oldId]
+		k.ids[k.keys[oldId]] = newId
+	}
+	k.keys = keys
+	return mapping
+}
+
+// SaveKeys writes the keys of all internal ids to w, deleted keys included.
+func (k *KeyIndex[K]) SaveKeys(w io.Writer) error {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	writer := &util.ErrWriter{W: w}
+	util.TryWriteValue[int32](int32(len(k.keys)), writer)
+	for _, key := range k.keys {
+		switch v := any(key).(type) {
+		case string:
+			util.TryWriteString(v, writer)
+		case uint64:
+			util.TryWriteValue[int64](int64(v), writer)
+		}
+	}
+	return writer.Err
+}
+
+// LoadKeyIndex wraps h whose keys have been saved by SaveKeys.
+func LoadKeyIndex[K Key](h *HNSW, r io.Reader) (*KeyIndex[K], error) {
+	h.initOnce.Do(h.initLocks)
+	h.globalLock.RLock()
+	defer h.globalLock.RUnlock()
+	h.slotLock.RLock()
+	defer h.slotLock.RUnlock()
+	reader := &util.ErrReader{R: r}
+	size := util.TryReadValue[int32](reader)
+	if reader.Err == nil && !h.coversDocs(size) {
+		return nil, fmt.Errorf("%w: key count: [%v] does not cover the docs", util.ErrCorruptFile, size)
+	}
+	k := &KeyIndex[K]{
+		HNSW: h,
+		keys: make([]K, 0, len(h.Docs)),
+		ids:  make(map[K]int32),
+		dim:  util.Max(h.dimension(), 0),
+	}
+	for id := int32(0); id < size && reader.Err == nil; id++ {
+		var key K
+		switch v := any(&key).(type) {
+		case *string:
+			*v = util.TryReadString(reader)
+		case *uint64:
+			*v = uint64(util.TryReadValue[int64](reader))
+		}
+		k.keys = append(k.keys, key)
+		if h.exists(id) && !h.isDeleted(id) {
+			if _, ok := k.ids[key]; ok {
+				return nil, fmt.Errorf("%w: %w: [%v]", util.ErrCorruptFile, util.ErrDuplicateKey, key)
+			}
+			k.ids[key] = id
+		}
+	}
+	if reader.Err != nil {
+		return nil, fmt.Errorf("%w: %v", util.ErrCorruptFile, reader.Err)
+	}
+	return k, nil
+}
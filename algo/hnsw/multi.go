@@ -0,0 +1,347 @@
+package hnsw
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/shiyinong/hnsw-go/data"
+	"github.com/shiyinong/hnsw-go/distance"
+	"github.com/shiyinong/hnsw-go/util"
+)
+
+// Aggregation decides how the vectors of a multi-vector doc are scored against a query.
+type Aggregation int32
+
+const (
+	// the score of the best matching vector
+	MaxSim Aggregation = 0
+	// the sum of the scores of the best n vectors
+	SumTopN Aggregation = 1
+)
+
+// MultiIndex indexes docs with multiple vectors, each vector is a doc of the HNSW with its own internal id.
+// All docs of the HNSW should be inserted through the MultiIndex.
+type MultiIndex struct {
+	HNSW *HNSW
+
+	// held for reading during Insert, for writing by Compact
+	maintainLock sync.RWMutex
+	// guards parents and children
+	lock sync.RWMutex
+	// internal id -> id of the multi-vector doc
+	parents []int32
+	// id of the multi-vector doc -> internal ids of its vectors, deleted docs are removed
+	children map[int32][]int32
+}
+
+// MultiResult is a multi-vector doc found by a search. Result.Doc is its best matching vector and
+// Result.Distance is the distance of it, Result.Score is the aggregated score.
+type MultiResult struct {
+	ParentId int32
+	data.Result
+}
+
+// NewMultiIndex wraps an empty HNSW.
+func NewMultiIndex(h *HNSW) (*MultiIndex, error) {
+	h.initOnce.Do(h.initLocks)
+	h.globalLock.RLock()
+	defer h.globalLock.RUnlock()
+	if len(h.Docs) > 0 {
+		return nil, fmt.Errorf("%w: index is not empty", util.ErrInvalidParam)
+	}
+	return &MultiIndex{
+		HNSW:     h,
+		children: make(map[int32][]int32),
+	}, nil
+}
+
+// Insert assigns internal ids to the vectors of doc and inserts them into the index. If a vector fails to be
+// inserted, the vectors inserted before it are deleted.
+func (m *MultiIndex) Insert(doc *data.MultiDoc) error {
+	if doc == nil || len(doc.Vectors) == 0 {
+		return fmt.Errorf("%w: doc has no vector", util.ErrInvalidParam)
+	}
+	m.maintainLock.RLock()
+	defer m.maintainLock.RUnlock()
+	m.lock.Lock()
+	if _, ok := m.children[doc.Id]; ok {
+		m.lock.Unlock()
+		return fmt.Errorf("%w: [%v]", util.ErrDuplicateId, doc.Id)
+	}
+	ids := make([]int32, len(doc.Vectors))
+	for i := range ids {
+		ids[i] = int32(len(m.parents))
+		m.parents = append(m.parents, doc.Id)
+	}
+	m.children[doc.Id] = ids
+	m.lock.Unlock()
+
+	for i, vector := range doc.Vectors {
+		if err := m.HNSW.Insert(&data.Doc{Id: ids[i], Vector: vector, Payload: doc.Payload}); err != nil {
+			// the ids are not reused, the holes are removed by Compact
+			m.lock.Lock()
+			delete(m.children, doc.Id)
+			m.lock.Unlock()
+			for _, id := range ids[:i] {
+				m.HNSW.Delete(id)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete deletes all vectors of doc id, it returns false if the doc does not exist.
+func (m *MultiIndex) Delete(id int32) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	ids, ok := m.children[id]
+	if !ok {
+		return false
+	}
+	delete(m.children, id)
+	for _, childId := range ids {
+		m.HNSW.Delete(childId)
+	}
+	return true
+}
+
+// Search returns the k multi-vector docs with the highest aggregated scores, n is the number of vectors
+// summed up by SumTopN. The traversal keeps the ef nearest distinct docs by their best vector found so far,
+// then all vectors of the candidates are scored exactly.
+func (m *MultiIndex) Search(query []float32, k, ef int32, agg Aggregation, n int32) ([]*MultiResult, error) {
+	if k < 1 {
+		return nil, fmt.Errorf("%w: k: [%v] should be positive", util.ErrInvalidParam, k)
+	}
+	if agg != MaxSim && agg != SumTopN {
+		return nil, fmt.Errorf("%w: unknown aggregation: [%v]", util.ErrInvalidParam, agg)
+	}
+	if agg == SumTopN && n < 1 {
+		return nil, fmt.Errorf("%w: n: [%v] should be positive", util.ErrInvalidParam, n)
+	}
+	h := m.HNSW
+	h.initOnce.Do(h.initLocks)
+	s := h.getScratch()
+	defer h.putScratch(s)
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	h.globalLock.RLock()
+	defer h.globalLock.RUnlock()
+	if err := h.checkQuery(query); err != nil {
+		return nil, err
+	}
+	query = s.normalizeQuery(query, h.Normalize)
+	if ef <= 0 {
+		ef = h.Ef
+	}
+	ef = util.Max(ef, k)
+
+	entryPoint := h.EntryPoint
+	for layer := h.MaxLayer; layer > 0; layer-- {
+		entryPoint = h.searchAtLayerWith1Ef(query, entryPoint, layer, s)
+	}
+	result := m.searchParents(query, entryPoint, ef, s)
+
+	scoreFunc := distance.ScoreFuncMap[h.DisType]
+	results := make([]*MultiResult, 0, result.Size())
+	distances := []float32{}
+	for result.Size() > 0 {
+		parentId := m.parents[result.Pop().(*data.Element).Doc.Id]
+		var best *data.Doc
+		bestDis := float32(0)
+		distances = distances[:0]
+		h.slotLock.RLock()
+		for _, id := range m.children[parentId] {
+			if !h.exists(id) || h.isDeleted(id) {
+				// still being inserted
+				continue
+			}
+			dis := h.DisFunc(query, h.Docs[id].Vector)
+			s.computeCnt++
+			if best == nil || dis < bestDis {
+				best, bestDis = h.Docs[id], dis
+			}
+			distances = append(distances, dis)
+		}
+		h.slotLock.RUnlock()
+		if best == nil {
+			// deleted after its vector was found
+			continue
+		}
+		score := scoreFunc(bestDis)
+		if agg == SumTopN {
+			sort.Slice(distances, func(i, j int) bool {
+				return distances[i] < distances[j]
+			})
+			score = 0
+			for _, dis := range distances[:util.Min(int(n), len(distances))] {
+				score += scoreFunc(dis)
+			}
+		}
+		results = append(results, &MultiResult{
+			ParentId: parentId,
+			Result: data.Result{
+				Doc:      best,
+				Distance: bestDis,
+				Score:    score,
+			},
+		})
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].Distance < results[j].Distance
+	})
+	if len(results) > int(k) {
+		results = results[:k]
+	}
+	return results, nil
+}
+
+// searchParents is like HNSW.searchAtLayer at layer 0, but result holds one element per multi-vector doc with
+// its nearest vector found so far, so that a doc is kept by any of its vectors. m.lock and h.globalLock must
+// be held.
+func (m *MultiIndex) searchParents(query []float32, enterPoint *data.Doc, ef int32, s *scratch) *util.Heap {
+	h := m.HNSW
+	candidates, result := s.candidates, s.result
+	candidates.Reset()
+	result.Reset()
+	s.resetElements()
+	// id of the multi-vector doc -> its element in result
+	best := map[int32]*data.Element{}
+	// add puts the vector doc at dis into result, h.globalLock must be held
+	add := func(doc *data.Doc, dis float32) {
+		if h.isDeleted(doc.Id) {
+			return
+		}
+		parentId := m.parents[doc.Id]
+		if ele, ok := best[parentId]; ok {
+			if dis < ele.Distance {
+				ele.Doc, ele.Distance = doc, dis
+				// result holds at most ef elements
+				for i, e := range result.Elements {
+					if e == ele {
+						result.Fix(i)
+						break
+					}
+				}
+			}
+			return
+		}
+		ele := s.newElement(doc, dis)
+		if int32(result.Size()) < ef {
+			result.Push(ele)
+		} else {
+			delete(best, m.parents[result.PopAndPush(ele).(*data.Element).Doc.Id])
+		}
+		best[parentId] = ele
+	}
+	dis := h.DisFunc(query, enterPoint.Vector)
+	s.computeCnt++
+	candidates.Push(s.newElement(enterPoint, dis))
+	add(enterPoint, dis)
+	s.visited.reset(len(h.Docs))
+	s.visited.visit(enterPoint.Id)
+	for candidates.Size() > 0 {
+		candidate := candidates.Pop().(*data.Element)
+		if int32(result.Size()) >= ef && candidate.Distance > result.Top().GetValue() || s.expired() {
+			break
+		}
+		for _, n := range h.getNeighbors(candidate.Doc.Id, 0, s) {
+			if s.visited.visit(n.Doc.Id) {
+				continue
+			}
+			bound := float32(math.MaxFloat32)
+			if int32(result.Size()) >= ef {
+				bound = result.Top().GetValue()
+			}
+			dis := h.BoundedDisFunc(n.Doc.Vector, query, bound)
+			s.computeCnt++
+			if int32(result.Size()) >= ef && bound <= dis {
+				continue
+			}
+			candidates.Push(s.newElement(n.Doc, dis))
+			add(n.Doc, dis)
+		}
+	}
+	return result
+}
+
+// ParentId returns the id of the multi-vector doc of internal id.
+func (m *MultiIndex) ParentId(id int32) (int32, bool) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if id < 0 || int(id) >= len(m.parents) {
+		return 0, false
+	}
+	return m.parents[id], true
+}
+
+// Compact is like HNSW.Compact, and the vectors of docs are remapped to the new internal ids.
+func (m *MultiIndex) Compact() []int32 {
+	m.maintainLock.Lock()
+	defer m.maintainLock.Unlock()
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	mapping := m.HNSW.Compact()
+	parents := make([]int32, len(m.HNSW.Docs))
+	for oldId, newId := range mapping {
+		if newId >= 0 {
+			parents[newId] = m.parents[oldId]
+		}
+	}
+	for parentId, ids := range m.children {
+		for i, id := range ids {
+			ids[i] = mapping[id]
+		}
+		m.children[parentId] = ids
+	}
+	m.parents = parents
+	return mapping
+}
+
+// SaveParents writes the doc ids of all internal ids to w, deleted docs included.
+func (m *MultiIndex) SaveParents(w io.Writer) error {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	writer := &util.ErrWriter{W: w}
+	util.TryWriteValue[int32](int32(len(m.parents)), writer)
+	for _, parentId := range m.parents {
+		util.TryWriteValue[int32](parentId, writer)
+	}
+	return writer.Err
+}
+
+// LoadMultiIndex wraps h whose doc ids have been saved by SaveParents.
+func LoadMultiIndex(h *HNSW, r io.Reader) (*MultiIndex, error) {
+	h.initOnce.Do(h.initLocks)
+	h.globalLock.RLock()
+	defer h.globalLock.RUnlock()
+	h.slotLock.RLock()
+	defer h.slotLock.RUnlock()
+	reader := &util.ErrReader{R: r}
+	size := util.TryReadValue[int32](reader)
+	if reader.Err == nil && !h.coversDocs(size) {
+		return nil, fmt.Errorf("%w: parent count: [%v] does not cover the docs", util.ErrCorruptFile, size)
+	}
+	m := &MultiIndex{
+		HNSW:     h,
+		parents:  make([]int32, 0, len(h.Docs)),
+		children: make(map[int32][]int32),
+	}
+	for id := int32(0); id < size && reader.Err == nil; id++ {
+		parentId := util.TryReadValue[int32](reader)
+		m.parents = append(m.parents, parentId)
+		if h.exists(id) && !h.isDeleted(id) {
+			m.children[parentId] = append(m.children[parentId], id)
+		}
+	}
+	if reader.Err != nil {
+		return nil, fmt.Errorf("%w: %v", util.ErrCorruptFile, reader.Err)
+	}
+	return m, nil
+}
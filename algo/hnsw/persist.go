@@ -0,0 +1,226 @@
+package hnsw
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/shiyinong/hnsw-go/data"
+	"github.com/shiyinong/hnsw-go/distance"
+	"github.com/shiyinong/hnsw-go/util"
+)
+
+// max layer of the docs read by Load. A deleted doc may have more layers than MaxLayer, which is the layer of
+// the alive entry point, so the layer counts of docs are checked against this limit instead
+const maxLoadLayer = 1 << 10
+
+// Save writes the index to w, which can be read back by Load. Empty slots of Docs are kept, so the ids of the
+// loaded index are the same. The distance is recorded by name, since the types of custom distances depend on
+// the registration order, and util.ErrUnregisteredDistance is returned if h.DisType is not registered.
+// Insertions wait until Save returns, w should be buffered.
+func (h *HNSW) Save(w io.Writer) error {
+	h.initOnce.Do(h.initLocks)
+	h.maintainLock.Lock()
+	defer h.maintainLock.Unlock()
+	h.globalLock.RLock()
+	defer h.globalLock.RUnlock()
+	if h.DisType.Name() == "" {
+		return fmt.Errorf("%w: distance type: [%v]", util.ErrUnregisteredDistance, h.DisType)
+	}
+	writer := &util.ErrWriter{W: w}
+	entryPointId := int32(-1)
+	if h.EntryPoint != nil {
+		entryPointId = h.EntryPoint.Id
+	}
+	dim := util.Max(h.dimension(), 0)
+	util.TryWriteValue[int32](h.EfCons, writer)
+	util.TryWriteValue[int32](h.Ef, writer)
+	util.TryWriteValue[int32](h.M, writer)
+	util.TryWriteValue[int32](h.M0, writer)
+	util.TryWriteValue[float64](h.NormFactor, writer)
+	util.TryWriteValue[int32](int32(h.Mode), writer)
+	util.TryWriteValue[int32](entryPointId, writer)
+	util.TryWriteValue[int32](h.MaxLayer, writer)
+	util.TryWriteString(h.DisType.Name(), writer)
+	util.TryWriteValue[int32](boolToInt32(h.ExtendCandidates), writer)
+	util.TryWriteValue[int32](boolToInt32(h.KeepPrunedConnections), writer)
+	util.TryWriteValue[float32](h.Alpha, writer)
+	util.TryWriteValue[int32](boolToInt32(h.Normalize), writer)
+	util.TryWriteValue[int32](int32(len(h.Docs)), writer)
+	util.TryWriteValue[int32](int32(dim), writer)
+	for _, doc := range h.Docs {
+		// -1 marks an empty slot
+		if doc == nil {
+			util.TryWriteValue[int32](-1, writer)
+			continue
+		}
+		util.TryWriteValue[int32](doc.Id, writer)
+		for _, v := range doc.Vector {
+			util.TryWriteValue[float32](v, writer)
+		}
+		util.TryWriteString(string(doc.Payload), writer)
+	}
+	deletedIds := []int32{}
+	for id, deleted := range h.Deleted {
+		if deleted {
+			deletedIds = append(deletedIds, int32(id))
+		}
+	}
+	util.TryWriteValue[int32](int32(len(deletedIds)), writer)
+	for _, id := range deletedIds {
+		util.TryWriteValue[int32](id, writer)
+	}
+	for id := range h.Docs {
+		var layers [][]*Neighbor
+		if id < len(h.Neighbors) {
+			layers = h.Neighbors[id]
+		}
+		util.TryWriteValue[int32](int32(len(layers)), writer)
+		for _, layer := range layers {
+			util.TryWriteValue[int32](int32(len(layer)), writer)
+			for _, n := range layer {
+				util.TryWriteValue[int32](n.Doc.Id, writer)
+				util.TryWriteValue[float32](n.Dis, writer)
+			}
+		}
+	}
+	return writer.Err
+}
+
+// Load reads an index written by Save from r. The distance should be registered before loading, otherwise
+// util.ErrUnregisteredDistance is returned. util.ErrCorruptFile is returned if the data is truncated or has
+// invalid content. Load reads no more than Save wrote, so r can be shared with the data that follows.
+func Load(r io.Reader) (*HNSW, error) {
+	reader := &util.ErrReader{R: r}
+	// readSize reads a size and makes sure it is in [0, limit], 0 is returned if the size is invalid
+	readSize := func(limit int32) int32 {
+		size := util.TryReadValue[int32](reader)
+		if reader.Err == nil && (size < 0 || size > limit) {
+			reader.Err = fmt.Errorf("size [%v] is out of range [0, %v]", size, limit)
+		}
+		if reader.Err != nil {
+			return 0
+		}
+		return size
+	}
+
+	efCons := util.TryReadValue[int32](reader)
+	ef := util.TryReadValue[int32](reader)
+	m := util.TryReadValue[int32](reader)
+	m0 := util.TryReadValue[int32](reader)
+	normFactor := util.TryReadValue[float64](reader)
+	mode := Mode(util.TryReadValue[int32](reader))
+	entryPointId := util.TryReadValue[int32](reader)
+	maxLayer := util.TryReadValue[int32](reader)
+	disName := util.TryReadString(reader)
+	heuristicOpts := HeuristicOptions{
+		ExtendCandidates:      util.TryReadValue[int32](reader) != 0,
+		KeepPrunedConnections: util.TryReadValue[int32](reader) != 0,
+		Alpha:                 util.TryReadValue[float32](reader),
+	}
+	normalize := util.TryReadValue[int32](reader) != 0
+	docSize := readSize(1 << 30)
+	dim := readSize(1 << 20)
+	if reader.Err == nil && (entryPointId < -1 || entryPointId >= docSize) {
+		reader.Err = fmt.Errorf("entry point [%v] is out of range", entryPointId)
+	}
+	if reader.Err == nil && (maxLayer < 0 || maxLayer > maxLoadLayer) {
+		reader.Err = fmt.Errorf("max layer [%v] is out of range", maxLayer)
+	}
+	if reader.Err != nil {
+		return nil, fmt.Errorf("%w: %v", util.ErrCorruptFile, reader.Err)
+	}
+	disType, ok := distance.Lookup(disName)
+	if !ok {
+		return nil, fmt.Errorf("%w: distance [%v] should be registered before loading", util.ErrUnregisteredDistance,
+			disName)
+	}
+	h, err := NewHNSW(m, efCons, mode, disType)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", util.ErrCorruptFile, err)
+	}
+	if err = h.SetNormalize(normalize); err != nil {
+		return nil, fmt.Errorf("%w: %v", util.ErrCorruptFile, err)
+	}
+	h.Ef, h.M0, h.NormFactor, h.MaxLayer = ef, m0, normFactor, maxLayer
+	h.HeuristicOptions = heuristicOpts
+
+	h.Docs = make([]*data.Doc, docSize)
+	for i := int32(0); i < docSize && reader.Err == nil; i++ {
+		id := util.TryReadValue[int32](reader)
+		if reader.Err != nil || id == -1 {
+			continue
+		}
+		if id != i {
+			reader.Err = fmt.Errorf("doc at [%v] has id [%v]", i, id)
+			break
+		}
+		vector := make([]float32, dim)
+		for j := int32(0); j < dim; j++ {
+			vector[j] = util.TryReadValue[float32](reader)
+		}
+		var payload []byte
+		if s := util.TryReadString(reader); s != "" {
+			payload = []byte(s)
+		}
+		h.Docs[i] = &data.Doc{
+			Id:      id,
+			Vector:  vector,
+			Payload: payload,
+		}
+	}
+	// readDoc reads an id and makes sure it is the id of a doc, nil is returned if the id is invalid
+	readDoc := func() *data.Doc {
+		id := util.TryReadValue[int32](reader)
+		if reader.Err == nil && (id < 0 || id >= docSize || h.Docs[id] == nil) {
+			reader.Err = fmt.Errorf("id [%v] is not a doc", id)
+		}
+		if reader.Err != nil {
+			return nil
+		}
+		return h.Docs[id]
+	}
+	h.Deleted = make([]bool, docSize)
+	deletedCnt := readSize(docSize)
+	for i := int32(0); i < deletedCnt && reader.Err == nil; i++ {
+		if doc := readDoc(); doc != nil {
+			h.Deleted[doc.Id] = true
+		}
+	}
+	h.Neighbors = make([][][]*Neighbor, docSize)
+	for i := int32(0); i < docSize && reader.Err == nil; i++ {
+		layerCnt := readSize(maxLoadLayer + 1)
+		if layerCnt == 0 {
+			continue
+		}
+		layers := make([][]*Neighbor, layerCnt)
+		for j := int32(0); j < layerCnt && reader.Err == nil; j++ {
+			neighborCnt := readSize(docSize)
+			ns := make([]*Neighbor, neighborCnt)
+			for n := int32(0); n < neighborCnt && reader.Err == nil; n++ {
+				doc := readDoc()
+				ns[n] = &Neighbor{
+					Doc: doc,
+					Dis: util.TryReadValue[float32](reader),
+				}
+			}
+			layers[j] = ns
+		}
+		h.Neighbors[i] = layers
+	}
+	if reader.Err == nil && entryPointId >= 0 {
+		if h.EntryPoint = h.Docs[entryPointId]; h.EntryPoint == nil {
+			reader.Err = fmt.Errorf("entry point [%v] is not a doc", entryPointId)
+		}
+	}
+	if reader.Err != nil {
+		return nil, fmt.Errorf("%w: %v", util.ErrCorruptFile, reader.Err)
+	}
+	return h, nil
+}
+
+func boolToInt32(b bool) int32 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,6 @@
+//go:build race
+
+package hnsw
+
+// sync.Pool drops items randomly under the race detector
+const raceEnabled = true
@@ -0,0 +1,39 @@
+package hnsw
+
+import (
+	"github.com/shiyinong/hnsw-go/data"
+	"github.com/shiyinong/hnsw-go/util"
+)
+
+// initial ef of SearchRange if HNSW.Ef is smaller
+const rangeInitEf = 32
+
+// SearchRange returns all docs whose distance to query is not greater than radius with their distances and
+// scores, nearest first. ef of the search at layer 0 is doubled until the farthest doc found is out of radius.
+// For similarity metrics radius is a distance as well, see distance.Type.
+func (h *HNSW) SearchRange(query []float32, radius float32) ([]*data.Result, error) {
+	h.initOnce.Do(h.initLocks)
+	s := h.getScratch()
+	defer h.putScratch(s)
+	h.globalLock.RLock()
+	defer h.globalLock.RUnlock()
+	if err := h.checkQuery(query); err != nil {
+		return nil, err
+	}
+	query = s.normalizeQuery(query, h.Normalize)
+	entryPoint := h.EntryPoint
+	for layer := h.MaxLayer; layer > 0; layer-- {
+		entryPoint = h.searchAtLayerWith1Ef(query, entryPoint, layer, s)
+	}
+	var result *util.Heap
+	for ef := util.Max(h.Ef, rangeInitEf); ; ef *= 2 {
+		result = h.searchAtLayer(query, entryPoint, ef, 0, nil, s)
+		if int32(result.Size()) < ef || result.Top().GetValue() > radius {
+			break
+		}
+	}
+	for result.Size() > 0 && result.Top().GetValue() > radius {
+		result.Pop()
+	}
+	return h.popResults(result), nil
+}
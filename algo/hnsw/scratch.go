@@ -0,0 +1,142 @@
+package hnsw
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/shiyinong/hnsw-go/data"
+	"github.com/shiyinong/hnsw-go/distance"
+	"github.com/shiyinong/hnsw-go/util"
+)
+
+// number of elements allocated at a time by scratch.newElement
+const elementChunkSize = 256
+
+// scratch holds the buffers of a search, it can be reused by the following searches of the same goroutine.
+// Scratches are pooled by HNSW, so that a search performs almost no heap allocation.
+type scratch struct {
+	visited visitedList
+	// buffers of searchAtLayer, result is returned to the caller and valid until the next searchAtLayer
+	candidates, result *util.Heap
+	// snapshot of a neighbor list
+	neighbors []*Neighbor
+	// normalized copy of the query
+	query []float32
+	// elements are handed out from chunks, chunks are kept for the following searches
+	chunks   [][]data.Element
+	chunkIdx int
+	eleIdx   int
+	// distance computations since the last flush
+	computeCnt int64
+	// stats of the current search, nil if not collected
+	stats *data.SearchStats
+	// the traversal stops after deadline, zero means no deadline
+	deadline time.Time
+	timedOut bool
+	// hops since the clock was read
+	deadlineTicks int
+}
+
+// visitedList marks visited docs with the current epoch, so that it is cleared by increasing the epoch.
+type visitedList struct {
+	marks []uint32
+	epoch uint32
+}
+
+func newScratch() *scratch {
+	return &scratch{
+		candidates: util.NewMinHeap(),
+		result:     util.NewMaxHeap(),
+	}
+}
+
+// reset clears the visited docs and makes sure docs in [0, size) can be marked.
+func (v *visitedList) reset(size int) {
+	if len(v.marks) < size {
+		v.marks = append(v.marks, make([]uint32, size-len(v.marks))...)
+	}
+	v.epoch++
+	if v.epoch == 0 {
+		clear(v.marks)
+		v.epoch = 1
+	}
+}
+
+// visit marks id as visited, and reports whether it has been visited before.
+func (v *visitedList) visit(id int32) bool {
+	if v.marks[id] == v.epoch {
+		return true
+	}
+	v.marks[id] = v.epoch
+	return false
+}
+
+// resetElements takes back all elements handed out.
+func (s *scratch) resetElements() {
+	s.chunkIdx, s.eleIdx = 0, 0
+}
+
+func (s *scratch) newElement(doc *data.Doc, dis float32) *data.Element {
+	if s.chunkIdx < len(s.chunks) && s.eleIdx == len(s.chunks[s.chunkIdx]) {
+		s.chunkIdx++
+		s.eleIdx = 0
+	}
+	if s.chunkIdx == len(s.chunks) {
+		s.chunks = append(s.chunks, make([]data.Element, elementChunkSize))
+	}
+	ele := &s.chunks[s.chunkIdx][s.eleIdx]
+	s.eleIdx++
+	ele.Doc, ele.Distance = doc, dis
+	return ele
+}
+
+// expired reports whether the deadline has passed, the clock is read every deadlineCheckInterval calls.
+func (s *scratch) expired() bool {
+	if s.timedOut || s.deadline.IsZero() {
+		return s.timedOut
+	}
+	s.deadlineTicks++
+	if s.deadlineTicks >= deadlineCheckInterval {
+		s.deadlineTicks = 0
+		s.timedOut = time.Now().After(s.deadline)
+	}
+	return s.timedOut
+}
+
+// normalizeQuery returns query scaled to unit length in s.query if normalize is set, otherwise query itself.
+func (s *scratch) normalizeQuery(query []float32, normalize bool) []float32 {
+	if !normalize {
+		return query
+	}
+	if cap(s.query) < len(query) {
+		s.query = make([]float32, len(query))
+	}
+	s.query = s.query[:len(query)]
+	distance.NormalizeTo(s.query, query)
+	return s.query
+}
+
+// getScratch takes a scratch from the pool.
+func (h *HNSW) getScratch() *scratch {
+	if s, ok := h.scratchPool.Get().(*scratch); ok {
+		return s
+	}
+	return newScratch()
+}
+
+// putScratch adds the distance computations of s to h.ComputeCnt, and puts s back to the pool.
+func (h *HNSW) putScratch(s *scratch) {
+	h.flushScratch(s)
+	s.candidates.Reset()
+	s.result.Reset()
+	s.resetElements()
+	s.stats = nil
+	s.deadline, s.timedOut, s.deadlineTicks = time.Time{}, false, 0
+	h.scratchPool.Put(s)
+}
+
+// flushScratch adds the distance computations of s to h.ComputeCnt.
+func (h *HNSW) flushScratch(s *scratch) {
+	atomic.AddInt64(&h.ComputeCnt, s.computeCnt)
+	s.computeCnt = 0
+}
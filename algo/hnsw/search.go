@@ -0,0 +1,142 @@
+package hnsw
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/shiyinong/hnsw-go/data"
+	"github.com/shiyinong/hnsw-go/util"
+)
+
+// EntryPointStrategy decides where a search starts at layer 0.
+type EntryPointStrategy int32
+
+const (
+	// descend from h.EntryPoint through the upper layers
+	EntryPointDescend EntryPointStrategy = 0
+	// start from h.EntryPoint at layer 0, the upper layers are ignored
+	EntryPointIgnoreLayer EntryPointStrategy = 1
+	// start from SearchOptions.EntryPointId at layer 0
+	EntryPointGiven EntryPointStrategy = 2
+)
+
+// number of hops between two reads of the clock when a search has a time budget
+const deadlineCheckInterval = 16
+
+type SearchOptions struct {
+	// number of docs returned
+	K int32
+	// size of the dynamic candidate list, h.Ef is used if not positive. It is raised to K if less than K
+	Ef int32
+
+	EntryPoint EntryPointStrategy
+	// doc to start from if EntryPoint is EntryPointGiven
+	EntryPointId int32
+
+	// only docs accepted by Filter are returned, nil accepts every doc. Rejected docs are still passed through,
+	// and the accepted docs are scanned exactly if Filter is very selective, see SearchKNNFiltered
+	Filter func(id int32) bool
+
+	// the traversal stops once TimeBudget is used up, and the nearest docs found so far are returned.
+	// 0 means no limit
+	TimeBudget time.Duration
+
+	// whether the SearchStats of the search is returned
+	CollectStats bool
+}
+
+// knnOptions converts the positional arguments of SearchKNN to SearchOptions.
+func knnOptions(ef, k, ignoreLayer int32) SearchOptions {
+	opts := SearchOptions{
+		K:  k,
+		Ef: ef,
+	}
+	if ignoreLayer != 0 {
+		opts.EntryPoint = EntryPointIgnoreLayer
+	}
+	return opts
+}
+
+// Search returns the nearest opts.K docs, nearest first. The stats are nil unless opts.CollectStats is set.
+// It is safe to call Search from multiple goroutines.
+func (h *HNSW) Search(query []float32, opts SearchOptions) ([]*data.Result, *data.SearchStats, error) {
+	start := time.Now()
+	h.initOnce.Do(h.initLocks)
+	s := h.getScratch()
+	defer h.putScratch(s)
+	var stats *data.SearchStats
+	if opts.CollectStats {
+		stats = &data.SearchStats{}
+		s.stats = stats
+	}
+	if opts.TimeBudget > 0 {
+		s.deadline = start.Add(opts.TimeBudget)
+	}
+	computeCnt := s.computeCnt
+	h.globalLock.RLock()
+	results, err := h.search(query, opts, s)
+	h.globalLock.RUnlock()
+	if err != nil {
+		return nil, nil, err
+	}
+	if stats != nil {
+		stats.ComputeCnt = s.computeCnt - computeCnt
+		stats.TimedOut = s.timedOut
+		stats.Cost = time.Since(start)
+	}
+	return results, stats, nil
+}
+
+// search does the work of Search, h.globalLock must be held.
+func (h *HNSW) search(query []float32, opts SearchOptions, s *scratch) ([]*data.Result, error) {
+	if err := h.checkQuery(query); err != nil {
+		return nil, err
+	}
+	query = s.normalizeQuery(query, h.Normalize)
+	if opts.K < 1 {
+		return nil, fmt.Errorf("%w: k: [%v] should be positive", util.ErrInvalidParam, opts.K)
+	}
+	ef := opts.Ef
+	if ef <= 0 {
+		ef = h.Ef
+	}
+	ef = util.Max(ef, opts.K)
+
+	var result *util.Heap
+	if opts.Filter != nil && h.estimateAcceptRatio(opts.Filter) < filterExactRatio {
+		result = h.scanFiltered(query, opts.K, opts.Filter, s)
+	} else {
+		entryPoint, err := h.searchEntryPoint(query, opts, s)
+		if err != nil {
+			return nil, err
+		}
+		result = h.searchAtLayer(query, entryPoint, ef, 0, opts.Filter, s)
+	}
+	for result.Size() > int(opts.K) {
+		result.Pop()
+	}
+	return h.popResults(result), nil
+}
+
+// searchEntryPoint returns the doc to start from at layer 0, h.globalLock must be held.
+func (h *HNSW) searchEntryPoint(query []float32, opts SearchOptions, s *scratch) (*data.Doc, error) {
+	switch opts.EntryPoint {
+	case EntryPointDescend:
+		entryPoint := h.EntryPoint
+		for layer := h.MaxLayer; layer > 0; layer-- {
+			entryPoint = h.searchAtLayerWith1Ef(query, entryPoint, layer, s)
+		}
+		return entryPoint, nil
+	case EntryPointIgnoreLayer:
+		return h.EntryPoint, nil
+	case EntryPointGiven:
+		h.slotLock.RLock()
+		defer h.slotLock.RUnlock()
+		if !h.exists(opts.EntryPointId) {
+			return nil, fmt.Errorf("%w: entry point: [%v]", util.ErrInvalidId, opts.EntryPointId)
+		}
+		return h.Docs[opts.EntryPointId], nil
+	default:
+		return nil, fmt.Errorf("%w: unknown entry point strategy: [%v]", util.ErrInvalidParam, opts.EntryPoint)
+	}
+}
@@ -0,0 +1,137 @@
+package hnsw
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/shiyinong/hnsw-go/algo/brute_force"
+	"github.com/shiyinong/hnsw-go/data"
+	"github.com/shiyinong/hnsw-go/util"
+)
+
+// EfPoint is the recall and the average latency of searches with Ef.
+type EfPoint struct {
+	Ef      int32
+	Recall  float64
+	Latency time.Duration
+}
+
+// TuneEf finds the smallest ef whose recall of the top k docs of sampleQueries is at least targetRecall,
+// and stores it in h.Ef along with the measured points in h.EfCurve. The ground truth is computed by
+// brute force, and the recall is assumed to grow with ef: ef is doubled from k until the target is hit,
+// then binary searched. util.ErrInvalidParam is returned if the target cannot be hit even if every doc
+// is a candidate, h.Ef is set to the ef with the best recall in this case.
+func (h *HNSW) TuneEf(sampleQueries [][]float32, k int32, targetRecall float64) (int32, error) {
+	if len(sampleQueries) == 0 {
+		return 0, fmt.Errorf("%w: no sample query", util.ErrInvalidParam)
+	}
+	if k < 1 {
+		return 0, fmt.Errorf("%w: k: [%v] should be positive", util.ErrInvalidParam, k)
+	}
+	if targetRecall <= 0 || targetRecall > 1 {
+		return 0, fmt.Errorf("%w: target recall: [%v] should be in (0, 1]", util.ErrInvalidParam, targetRecall)
+	}
+	h.initOnce.Do(h.initLocks)
+	h.globalLock.RLock()
+	h.slotLock.RLock()
+	alive := make([]*data.Doc, 0, len(h.Docs))
+	for id, doc := range h.Docs {
+		if doc != nil && !h.isDeleted(int32(id)) {
+			alive = append(alive, doc)
+		}
+	}
+	h.slotLock.RUnlock()
+	h.globalLock.RUnlock()
+	if len(alive) == 0 {
+		return 0, util.ErrEmptyIndex
+	}
+
+	bf := &brute_force.Searcher{Docs: alive}
+	truth := make([]map[int32]struct{}, len(sampleQueries))
+	truthCnt := 0
+	for i, query := range sampleQueries {
+		results, err := bf.QueryWithScore(query, k, h.DisType)
+		if err != nil {
+			return 0, err
+		}
+		truth[i] = make(map[int32]struct{}, len(results))
+		for _, r := range results {
+			truth[i][r.Doc.Id] = struct{}{}
+		}
+		truthCnt += len(results)
+	}
+	measure := func(ef int32) (EfPoint, error) {
+		hitCnt := 0
+		start := time.Now()
+		for i, query := range sampleQueries {
+			results, _, err := h.Search(query, SearchOptions{K: k, Ef: ef})
+			if err != nil {
+				return EfPoint{}, err
+			}
+			for _, r := range results {
+				if _, ok := truth[i][r.Doc.Id]; ok {
+					hitCnt++
+				}
+			}
+		}
+		return EfPoint{
+			Ef:      ef,
+			Recall:  float64(hitCnt) / float64(truthCnt),
+			Latency: time.Since(start) / time.Duration(len(sampleQueries)),
+		}, nil
+	}
+
+	curve := []EfPoint{}
+	// lo misses the target, hi hits it. ef less than k is raised to k by Search
+	lo, hi := k-1, int32(-1)
+	maxEf := util.Max(int32(len(alive)), k)
+	for ef := k; ; ef = util.Min(2*ef, maxEf) {
+		point, err := measure(ef)
+		if err != nil {
+			return 0, err
+		}
+		curve = append(curve, point)
+		if point.Recall >= targetRecall {
+			hi = ef
+			break
+		}
+		lo = ef
+		if ef == maxEf {
+			break
+		}
+	}
+	for hi > 0 && hi-lo > 1 {
+		mid := lo + (hi-lo)/2
+		point, err := measure(mid)
+		if err != nil {
+			return 0, err
+		}
+		curve = append(curve, point)
+		if point.Recall >= targetRecall {
+			hi = mid
+		} else {
+			lo = mid
+		}
+	}
+	sort.Slice(curve, func(i, j int) bool {
+		return curve[i].Ef < curve[j].Ef
+	})
+
+	var err error
+	if hi < 0 {
+		best := curve[0]
+		for _, point := range curve {
+			if point.Recall > best.Recall {
+				best = point
+			}
+		}
+		hi = best.Ef
+		err = fmt.Errorf("%w: target recall: [%v] is not hit, best recall: [%v] with ef: [%v]",
+			util.ErrInvalidParam, targetRecall, best.Recall, best.Ef)
+	}
+	h.globalLock.Lock()
+	h.Ef, h.EfCurve = hi, curve
+	h.globalLock.Unlock()
+	return hi, err
+}
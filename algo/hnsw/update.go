@@ -0,0 +1,159 @@
+package hnsw
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/shiyinong/hnsw-go/data"
+	"github.com/shiyinong/hnsw-go/distance"
+	"github.com/shiyinong/hnsw-go/util"
+)
+
+// Update replaces the vector of doc id and relinks the doc at all its layers. Links pointing to the doc
+// are refreshed within two hops of its old position, links from farther docs keep their old distance.
+// The doc passed to Insert is not modified, vector is shared with the index and should not be modified.
+// It returns false if the doc does not exist, has been deleted or vector has a wrong dimension.
+func (h *HNSW) Update(id int32, vector []float32) bool {
+	h.initOnce.Do(h.initLocks)
+	h.maintainLock.Lock()
+	defer h.maintainLock.Unlock()
+	h.globalLock.Lock()
+	defer h.globalLock.Unlock()
+	if !h.exists(id) || h.isDeleted(id) || len(vector) != h.dimension() {
+		return false
+	}
+	h.update(h.Docs[id], vector)
+	return true
+}
+
+// Upsert updates the vector and the payload of doc.Id if it is in the index, otherwise doc is inserted.
+// A deleted doc is brought back to life with the new vector.
+func (h *HNSW) Upsert(doc *data.Doc) error {
+	h.initOnce.Do(h.initLocks)
+	h.maintainLock.Lock()
+	defer h.maintainLock.Unlock()
+	h.globalLock.Lock()
+	if doc == nil || !h.exists(doc.Id) {
+		h.globalLock.Unlock()
+		return h.insert(doc)
+	}
+	defer h.globalLock.Unlock()
+	if dim := h.dimension(); dim != len(doc.Vector) {
+		return fmt.Errorf("%w: index dim: [%v] != doc dim: [%v]", util.ErrDimensionMismatch, dim, len(doc.Vector))
+	}
+	if h.isDeleted(doc.Id) {
+		h.Deleted[doc.Id] = false
+		if h.EntryPoint == nil || int32(len(h.Neighbors[doc.Id])-1) > h.MaxLayer {
+			h.EntryPoint, h.MaxLayer = h.Docs[doc.Id], int32(len(h.Neighbors[doc.Id])-1)
+		}
+	}
+	h.Docs[doc.Id].Payload = doc.Payload
+	h.update(h.Docs[doc.Id], doc.Vector)
+	return nil
+}
+
+// coversDocs reports whether the ids of all docs are less than size, and size is within Docs, the slots
+// beyond the docs may be reserved. h.globalLock and h.slotLock must be held.
+func (h *HNSW) coversDocs(size int32) bool {
+	if size < 0 || int(size) > len(h.Docs) {
+		return false
+	}
+	for _, doc := range h.Docs[size:] {
+		if doc != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// exists reports whether doc id has been inserted, h.globalLock must be held.
+func (h *HNSW) exists(id int32) bool {
+	return id >= 0 && int(id) < len(h.Docs) && h.Docs[id] != nil
+}
+
+// update moves doc to vector, doc is the copy kept by the index. h.globalLock must be held for writing.
+func (h *HNSW) update(doc *data.Doc, vector []float32) {
+	if h.Normalize {
+		vector = distance.Normalize(vector)
+	}
+	doc.Vector = vector
+	layers := h.Neighbors[doc.Id]
+	maxLayer := int32(len(layers) - 1)
+
+	// the docs around the old position may link to doc with stale distances
+	for layer := maxLayer; layer >= 0; layer-- {
+		visited := map[int32]struct{}{doc.Id: {}}
+		affected := []int32{}
+		for _, n := range layers[layer] {
+			for _, nn := range append([]*Neighbor{n}, h.Neighbors[n.Doc.Id][layer]...) {
+				if _, ok := visited[nn.Doc.Id]; !ok {
+					visited[nn.Doc.Id] = struct{}{}
+					affected = append(affected, nn.Doc.Id)
+				}
+			}
+		}
+		for _, id := range affected {
+			h.relinkReverse(id, doc, layer)
+		}
+	}
+
+	s := h.getScratch()
+	defer h.putScratch(s)
+	entryPoint := h.EntryPoint
+	for layer := h.MaxLayer; layer > maxLayer; layer-- {
+		entryPoint = h.searchAtLayerWith1Ef(vector, entryPoint, layer, s)
+	}
+	for layer := maxLayer; layer >= 0; layer-- {
+		maxHeap := h.searchAtLayer(vector, entryPoint, h.EfCons+1, layer, nil, s)
+		candidates := util.NewMaxHeap()
+		for maxHeap.Size() > 0 {
+			if ele := maxHeap.Pop().(*data.Element); ele.Doc.Id != doc.Id {
+				candidates.Push(ele)
+			}
+		}
+		if h.Mode == Heuristic && h.ExtendCandidates {
+			h.extendCandidates(doc, candidates, layer, s)
+		}
+		neighbors := h.selectNeighborsFromMaxHeap(candidates, h.M)
+		h.Neighbors[doc.Id][layer] = neighbors
+		for _, n := range neighbors {
+			if !h.relinkReverse(n.Doc.Id, doc, layer) {
+				h.Neighbors[n.Doc.Id][layer] = h.addNeighbor(
+					h.Neighbors[n.Doc.Id][layer],
+					&Neighbor{
+						Doc: doc,
+						Dis: n.Dis,
+					},
+					layer,
+				)
+			}
+		}
+		if len(neighbors) > 0 {
+			entryPoint = neighbors[0].Doc
+		}
+	}
+}
+
+// relinkReverse recomputes the distance of the link from doc id to doc at layer and reselects the
+// neighbors of doc id, it returns false if there is no such link. h.globalLock must be held for writing.
+func (h *HNSW) relinkReverse(id int32, doc *data.Doc, layer int32) bool {
+	neighbors := h.Neighbors[id][layer]
+	found := false
+	maxHeap := util.NewMaxHeap()
+	for _, n := range neighbors {
+		dis := n.Dis
+		if n.Doc.Id == doc.Id {
+			found = true
+			dis = h.DisFunc(h.Docs[id].Vector, doc.Vector)
+			atomic.AddInt64(&h.ComputeCnt, 1)
+		}
+		maxHeap.Push(&data.Element{
+			Doc:      n.Doc,
+			Distance: dis,
+		})
+	}
+	if found {
+		h.Neighbors[id][layer] = h.selectNeighborsFromMaxHeap(maxHeap, h.getMaxNeighborCnt(layer))
+	}
+	return found
+}
@@ -2,7 +2,10 @@ package nsw
 
 import (
 	"fmt"
+	"math"
 	"math/rand"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/shiyinong/hnsw-go/data"
@@ -15,21 +18,65 @@ type NSW struct {
 	// id of doc
 	Links [][]int32
 	// count of node neighbors
-	F          int32
-	W          int32
-	DisFunc    func(vec1, vec2 []float32) float32
+	F       int32
+	W       int32
+	DisType distance.Type
+	DisFunc func(vec1, vec2 []float32) float32
+	// DisFunc which stops early once the distance exceeds the bound, used to discard far neighbors in searches
+	BoundedDisFunc distance.BoundedFunc
+	// total distance computations of all insertions and searches, use SearchKNNWithStats for a single search.
+	// It is updated atomically
 	ComputeCnt int64
+	// picks the entry points of searches, the global source of math/rand is used if nil
+	Rand *rand.Rand
+
+	// guards Rand, which is not safe for concurrent searches
+	randLock sync.Mutex
 }
 
-func (n *NSW) Stat() {
+// Stat prints the average neighbor count, it returns util.ErrEmptyIndex if there is no doc.
+func (n *NSW) Stat() error {
+	if len(n.Docs) == 0 {
+		return util.ErrEmptyIndex
+	}
 	cnt := 0
 	for _, link := range n.Links {
 		cnt += len(link)
 	}
 	fmt.Printf("NSW node avg neighbors count: [%v]\n", cnt/len(n.Docs))
+	return nil
+}
+
+// NewNSW is like BuildNSW, but the params and docs are checked.
+func NewNSW(docs []*data.Doc, f, w int32, disType distance.Type) (*NSW, error) {
+	if len(docs) == 0 {
+		return nil, fmt.Errorf("%w: data is nil", util.ErrInvalidParam)
+	}
+	if f < 1 || w < 1 {
+		return nil, fmt.Errorf("%w: f: [%v] and w: [%v] should be positive", util.ErrInvalidParam, f, w)
+	}
+	if _, ok := distance.FuncMap[disType]; !ok {
+		return nil, fmt.Errorf("%w: unknown distance type: [%v]", util.ErrInvalidParam, disType)
+	}
+	for i, doc := range docs {
+		if doc == nil || doc.Id != int32(i) {
+			return nil, fmt.Errorf("%w: doc at [%v] should have id [%v]", util.ErrInvalidId, i, i)
+		}
+		if err := distance.CheckDimension(docs[0].Vector, doc.Vector); err != nil {
+			return nil, err
+		}
+	}
+	return BuildNSW(docs, f, w, disType), nil
 }
 
 func BuildNSW(docs []*data.Doc, f, w int32, disType distance.Type) *NSW {
+	return BuildNSWWithSeed(docs, f, w, disType, time.Now().UnixMicro())
+}
+
+// BuildNSWWithSeed is like BuildNSW, but entry points are picked by a random source of seed, so that the
+// same docs build identical graphs. If the distance requires normalization, the index keeps copies of docs
+// with normalized vectors, and docs are not modified.
+func BuildNSWWithSeed(docs []*data.Doc, f, w int32, disType distance.Type, seed int64) *NSW {
 	if len(docs) == 0 {
 		panic("data is nil")
 	}
@@ -39,13 +86,23 @@ func BuildNSW(docs []*data.Doc, f, w int32, disType distance.Type) *NSW {
 		Links:   make([][]int32, docCount),
 		F:       f,
 		W:       w,
+		DisType: disType,
 		DisFunc: distance.FuncMap[disType],
+		Rand:    rand.New(rand.NewSource(seed)),
+
+		BoundedDisFunc: distance.BoundedFuncMap[disType],
 	}
+	normalize := disType.Properties().RequiresNormalization
 	start, s1 := time.Now(), time.Now()
 	for _, curDoc := range docs {
+		if normalize {
+			newDoc := *curDoc
+			newDoc.Vector = distance.Normalize(curDoc.Vector)
+			curDoc = &newDoc
+		}
 		neighbors := nsw.Docs
 		if len(nsw.Docs) > int(nsw.F) {
-			neighbors = nsw.SearchKNN(curDoc.Vector, nsw.F, nsw.W)
+			neighbors = data.ResultDocs(nsw.searchKNN(curDoc.Vector, nsw.F, nsw.W, nil))
 		}
 		nsw.Docs = append(nsw.Docs, curDoc)
 		for _, neighbor := range neighbors {
@@ -62,7 +119,41 @@ func BuildNSW(docs []*data.Doc, f, w int32, disType distance.Type) *NSW {
 	return nsw
 }
 
+// SearchKNN returns the nearest k docs, nearest first. It returns nil if the index is empty or query has a
+// wrong dimension, use SearchKNNWithScore to get the error.
 func (n *NSW) SearchKNN(query []float32, k, m int32) []*data.Doc {
+	results, _ := n.SearchKNNWithScore(query, k, m)
+	return data.ResultDocs(results)
+}
+
+// SearchKNNWithScore is like SearchKNN, but the distances and scores are returned along with the docs.
+func (n *NSW) SearchKNNWithScore(query []float32, k, m int32) ([]*data.Result, error) {
+	if len(n.Docs) == 0 {
+		return nil, util.ErrEmptyIndex
+	}
+	if err := distance.CheckDimension(n.Docs[0].Vector, query); err != nil {
+		return nil, err
+	}
+	return n.searchKNN(n.normalize(query), k, m, nil), nil
+}
+
+// SearchKNNWithStats is like SearchKNNWithScore, but the work done by the search is returned as well.
+func (n *NSW) SearchKNNWithStats(query []float32, k, m int32) ([]*data.Result, *data.SearchStats, error) {
+	start := time.Now()
+	if len(n.Docs) == 0 {
+		return nil, nil, util.ErrEmptyIndex
+	}
+	if err := distance.CheckDimension(n.Docs[0].Vector, query); err != nil {
+		return nil, nil, err
+	}
+	stats := &data.SearchStats{}
+	results := n.searchKNN(n.normalize(query), k, m, stats)
+	stats.Cost = time.Since(start)
+	return results, stats, nil
+}
+
+// searchKNN records the work done into stats if it is not nil.
+func (n *NSW) searchKNN(query []float32, k, m int32, stats *data.SearchStats) []*data.Result {
 	/*
 		1. build a min heap named candidates, build a max heap(size: k) named results.
 		2. get an entry Node by random, put it to the candidates and results.
@@ -71,43 +162,112 @@ func (n *NSW) SearchKNN(query []float32, k, m int32) []*data.Doc {
 	*/
 	visited := map[int32]struct{}{}
 	results, candidates := util.NewMaxHeap(), util.NewMinHeap()
+	computeCnt, visitedCnt, hopCnt, heapOpCnt := int64(0), int64(0), int64(0), int64(0)
 	for i := int32(0); i < m; i++ {
-		entry := n.Docs[rand.Int31n(int32(len(n.Docs)))]
+		entry := n.Docs[n.randInt31n(int32(len(n.Docs)))]
 		entryEle := &data.Element{
 			Doc:      entry,
 			Distance: n.DisFunc(entry.Vector, query),
 		}
+		computeCnt++
 		candidates.Push(entryEle)
-		visited[entry.Id] = struct{}{}
+		heapOpCnt++
+		if _, ok := visited[entry.Id]; !ok {
+			visited[entry.Id] = struct{}{}
+			visitedCnt++
+		}
 		for candidates.Size() > 0 {
 			cur := candidates.Pop().(*data.Element)
+			heapOpCnt++
 			if results.Size() > 0 && cur.Distance > results.Top().GetValue() {
 				break
 			}
+			hopCnt++
 			for _, neighborIdx := range n.Links[cur.Doc.Id] {
 				neighbor := n.Docs[neighborIdx]
 				if _, ok := visited[neighbor.Id]; ok {
 					continue
 				}
-				n.ComputeCnt++
+				computeCnt++
+				visitedCnt++
 				visited[neighbor.Id] = struct{}{}
+				bound := float32(math.MaxFloat32)
+				if results.Size() >= int(k) {
+					bound = results.Top().GetValue()
+				}
+				dis := n.BoundedDisFunc(neighbor.Vector, query, bound)
+				// a neighbor farther than all results would only end the search when it is popped
+				if dis > bound {
+					continue
+				}
 				ele := &data.Element{
 					Doc:      neighbor,
-					Distance: n.DisFunc(neighbor.Vector, query),
+					Distance: dis,
 				}
 				candidates.Push(ele)
+				heapOpCnt++
 				if results.Size() < int(k) {
 					results.Push(ele)
+					heapOpCnt++
 				} else if results.Top().GetValue() > ele.Distance {
 					results.PopAndPush(ele)
+					heapOpCnt++
 				}
 			}
 		}
 	}
-	topK := make([]*data.Doc, results.Size())
+	atomic.AddInt64(&n.ComputeCnt, computeCnt)
+	if stats != nil {
+		stats.ComputeCnt += computeCnt
+		stats.AddLayer(0, visitedCnt, hopCnt, heapOpCnt)
+	}
+	scoreFunc := distance.ScoreFuncMap[n.DisType]
+	topK := make([]*data.Result, results.Size())
 	for i := len(topK) - 1; i >= 0; i-- {
-		doc := results.Pop().(*data.Element).Doc
-		topK[i] = doc
+		ele := results.Pop().(*data.Element)
+		topK[i] = &data.Result{
+			Doc:      ele.Doc,
+			Distance: ele.Distance,
+			Score:    scoreFunc(ele.Distance),
+		}
 	}
 	return topK
 }
+
+// SearchRange returns all docs whose distance to query is not greater than radius with their distances and
+// scores, nearest first. k of the search is doubled until the farthest doc found is out of radius.
+func (n *NSW) SearchRange(query []float32, radius float32, m int32) ([]*data.Result, error) {
+	if len(n.Docs) == 0 {
+		return nil, util.ErrEmptyIndex
+	}
+	if err := distance.CheckDimension(n.Docs[0].Vector, query); err != nil {
+		return nil, err
+	}
+	query = n.normalize(query)
+	for k := int32(32); ; k *= 2 {
+		topK := n.searchKNN(query, k, m, nil)
+		if len(topK) < int(k) || topK[len(topK)-1].Distance > radius {
+			for len(topK) > 0 && topK[len(topK)-1].Distance > radius {
+				topK = topK[:len(topK)-1]
+			}
+			return topK, nil
+		}
+	}
+}
+
+// normalize returns a normalized copy of query if the distance requires normalization, otherwise query itself.
+func (n *NSW) normalize(query []float32) []float32 {
+	if !n.DisType.Properties().RequiresNormalization {
+		return query
+	}
+	return distance.Normalize(query)
+}
+
+func (n *NSW) randInt31n(max int32) int32 {
+	if n.Rand == nil {
+		return rand.Int31n(max)
+	}
+	n.randLock.Lock()
+	defer n.randLock.Unlock()
+	return n.Rand.Int31n(max)
+}
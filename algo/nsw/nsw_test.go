@@ -0,0 +1,141 @@
+package nsw
+
+import (
+	"math"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/shiyinong/hnsw-go/algo/brute_force"
+	"github.com/shiyinong/hnsw-go/data"
+	"github.com/shiyinong/hnsw-go/distance"
+)
+
+func TestDeterministicBuild(t *testing.T) {
+	n1 := BuildNSWWithSeed(data.BuildAllDocWithSeed(8, 1000, 42), 10, 2, distance.L2, 7)
+	n2 := BuildNSWWithSeed(data.BuildAllDocWithSeed(8, 1000, 42), 10, 2, distance.L2, 7)
+	if !reflect.DeepEqual(n1.Links, n2.Links) {
+		t.Fatalf("links differ")
+	}
+}
+
+func TestSearchKNNWithStats(t *testing.T) {
+	docs := data.BuildAllDocWithSeed(8, 1000, 42)
+	n := BuildNSWWithSeed(docs, 10, 2, distance.L2, 7)
+	res, stats, err := n.SearchKNNWithStats(docs[0].Vector, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 10 || len(stats.VisitedCnt) != 1 || stats.VisitedCnt[0] == 0 ||
+		stats.ComputeCnt < stats.VisitedCnt[0] || stats.HopCnt == 0 {
+		t.Fatalf("unexpected stats: [%+v]", stats)
+	}
+}
+
+func TestConcurrentSearch(t *testing.T) {
+	docs := data.BuildAllDocWithSeed(8, 1000, 42)
+	n := BuildNSWWithSeed(docs, 10, 2, distance.L2, 7)
+	before := n.ComputeCnt
+	wg := sync.WaitGroup{}
+	computeCnt := int64(0)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for _, doc := range docs[i*50 : (i+1)*50] {
+				_, stats, err := n.SearchKNNWithStats(doc.Vector, 10, 2)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				atomic.AddInt64(&computeCnt, stats.ComputeCnt)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if n.ComputeCnt-before != computeCnt {
+		t.Fatalf("compute count: [%v], expect: [%v]", n.ComputeCnt-before, computeCnt)
+	}
+}
+
+func TestSimilarityDistances(t *testing.T) {
+	docs := data.BuildAllDocWithSeed(8, 1000, 42)
+	bf := &brute_force.Searcher{Docs: docs}
+	for _, disType := range []distance.Type{distance.Cosine, distance.InnerProduct} {
+		n := BuildNSWWithSeed(docs, 10, 2, disType, 7)
+		hit := 0
+		for _, query := range data.BuildAllDocWithSeed(8, 50, 43) {
+			truth, _ := bf.QueryWithScore(query.Vector, 1, disType)
+			res, err := n.SearchKNNWithScore(query.Vector, 10, 4)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 1; i < len(res); i++ {
+				if res[i].Score > res[i-1].Score {
+					t.Fatalf("[%v] results are not ranked by score", disType)
+				}
+			}
+			if res[0].Doc.Id == truth[0].Doc.Id {
+				hit++
+			}
+		}
+		if hit < 45 {
+			t.Fatalf("[%v] recall too low: [%v / 50]", disType, hit)
+		}
+	}
+}
+
+var unitDot, errRegisterUnitDot = distance.Register("unit_dot", func(vec1, vec2 []float32) float32 {
+	return -distance.InnerProductDistance(vec1, vec2)
+}, distance.Properties{IsSimilarity: true, RequiresNormalization: true})
+
+func TestNormalizedDocsAreCopied(t *testing.T) {
+	if errRegisterUnitDot != nil {
+		t.Fatal(errRegisterUnitDot)
+	}
+	docs := data.BuildAllDocWithSeed(8, 1000, 42)
+	n := BuildNSWWithSeed(docs, 10, 2, unitDot, 7)
+	if !reflect.DeepEqual(docs, data.BuildAllDocWithSeed(8, 1000, 42)) {
+		t.Fatalf("input docs are modified")
+	}
+	if norm := distance.InnerProductDistance(n.Docs[0].Vector, n.Docs[0].Vector); math.Abs(float64(norm)+1) > 1e-5 {
+		t.Fatalf("vectors of [%v] are not normalized", unitDot)
+	}
+}
+
+func TestSearchRange(t *testing.T) {
+	docs := data.BuildAllDocWithSeed(8, 1000, 42)
+	bf := &brute_force.Searcher{Docs: docs}
+	n := BuildNSWWithSeed(docs, 10, 2, distance.L2, 7)
+	hitCnt, allCnt := 0, 0
+	for _, doc := range docs[:50] {
+		expect, err := bf.SearchRange(doc.Vector, 0.3, distance.L2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := n.SearchRange(doc.Vector, 0.3, 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := map[int32]struct{}{}
+		for i, r := range res {
+			if r.Distance > 0.3 || (i > 0 && r.Distance < res[i-1].Distance) {
+				t.Fatalf("results are out of radius or not sorted by distance")
+			}
+			m[r.Doc.Id] = struct{}{}
+		}
+		for _, e := range expect {
+			if _, ok := m[e.Doc.Id]; ok {
+				hitCnt++
+			}
+		}
+		allCnt += len(expect)
+	}
+	if float64(hitCnt) < 0.95*float64(allCnt) {
+		t.Fatalf("range recall too low: [%v / %v]", hitCnt, allCnt)
+	}
+	if _, err := n.SearchRange([]float32{1}, 0.3, 4); err == nil {
+		t.Fatalf("query with a wrong dimension should fail")
+	}
+}
@@ -22,145 +22,168 @@ type HnswWrap struct {
 }
 
 func SaveHnswWrap(wrap *HnswWrap, path string) {
+	if err := Save(wrap, path); err != nil {
+		panic(err)
+	}
+}
+
+// Save is like SaveHnswWrap, but the error is returned instead of panic. Nsw and TestData are optional.
+func Save(wrap *HnswWrap, path string) error {
 	start := time.Now()
+	if wrap.Hnsw == nil {
+		return util.ErrEmptyIndex
+	}
 	file, err := os.Create(path)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	h := wrap.Hnsw
-	writer := bufio.NewWriter(file)
-	util.WriteValue[int32](h.EfCons, writer)
-	util.WriteValue[int32](h.Ef, writer)
-	util.WriteValue[int32](h.M, writer)
-	util.WriteValue[int32](h.M0, writer)
-	util.WriteValue[float64](h.NormFactor, writer)
-	util.WriteValue[int32](int32(h.Mode), writer)
-	util.WriteValue[int32](h.EntryPoint.Id, writer)
-	util.WriteValue[int32](h.MaxLayer, writer)
-	util.WriteValue[int32](int32(h.DisType), writer)
-	util.WriteValue[int32](int32(len(h.Docs)), writer)
-	util.WriteValue[int32](int32(len(h.Docs[0].Vector)), writer)
-	for _, doc := range h.Docs {
-		util.WriteValue[int32](doc.Id, writer)
-		for _, v := range doc.Vector {
-			util.WriteValue[float32](v, writer)
-		}
+	defer file.Close()
+	bufWriter := bufio.NewWriter(file)
+	if err = wrap.Hnsw.Save(bufWriter); err != nil {
+		return err
 	}
-	for _, layers := range h.Neighbors {
-		util.WriteValue[int32](int32(len(layers)), writer)
-		for _, layer := range layers {
-			util.WriteValue[int32](int32(len(layer)), writer)
-			for _, n := range layer {
-				util.WriteValue[int32](n.Doc.Id, writer)
-				util.WriteValue[float32](n.Dis, writer)
+	writer := &util.ErrWriter{W: bufWriter}
+
+	// 0 means no nsw index
+	if wrap.Nsw == nil {
+		util.TryWriteValue[int32](0, writer)
+	} else {
+		util.TryWriteValue[int32](1, writer)
+		util.TryWriteValue[int32](wrap.Nsw.F, writer)
+		util.TryWriteValue[int32](wrap.Nsw.W, writer)
+		for id := range wrap.Hnsw.Docs {
+			var link []int32
+			if id < len(wrap.Nsw.Links) {
+				link = wrap.Nsw.Links[id]
+			}
+			util.TryWriteValue[int32](int32(len(link)), writer)
+			for _, v := range link {
+				util.TryWriteValue[int32](v, writer)
 			}
 		}
 	}
 
-	util.WriteValue[int32](wrap.Nsw.F, writer)
-	util.WriteValue[int32](wrap.Nsw.W, writer)
-	for _, link := range wrap.Nsw.Links {
-		util.WriteValue[int32](int32(len(link)), writer)
-		for _, v := range link {
-			util.WriteValue[int32](v, writer)
-		}
+	dim := 0
+	if len(wrap.TestData) > 0 {
+		dim = len(wrap.TestData[0].Vector)
 	}
-
-	util.WriteValue[int32](int32(len(wrap.TestData)), writer)
-	util.WriteValue[int32](int32(len(wrap.TestData[0].Vector)), writer)
+	util.TryWriteValue[int32](int32(len(wrap.TestData)), writer)
+	util.TryWriteValue[int32](int32(dim), writer)
 	for _, doc := range wrap.TestData {
-		util.WriteValue[int32](doc.Id, writer)
+		util.TryWriteValue[int32](doc.Id, writer)
 		for _, v := range doc.Vector {
-			util.WriteValue[float32](v, writer)
+			util.TryWriteValue[float32](v, writer)
 		}
 	}
-	for _, res := range wrap.TopK {
-		util.WriteValue[int32](int32(len(res)), writer)
+	for i := range wrap.TestData {
+		var res []*data.Doc
+		if i < len(wrap.TopK) {
+			res = wrap.TopK[i]
+		}
+		util.TryWriteValue[int32](int32(len(res)), writer)
 		for _, v := range res {
-			util.WriteValue[int32](v.Id, writer)
+			util.TryWriteValue[int32](v.Id, writer)
 		}
 	}
 
-	if err = writer.Flush(); err != nil {
-		panic(err)
+	if writer.Err != nil {
+		return writer.Err
+	}
+	if err = bufWriter.Flush(); err != nil {
+		return err
 	}
-
 	if err = file.Close(); err != nil {
-		panic(err)
+		return err
 	}
 	fmt.Printf("saveHnswWrap hnsw index cost: [%v]\n", time.Since(start))
+	return nil
 }
 
 func LoadHnswWrap(path string) *HnswWrap {
+	wrap, err := Load(path)
+	if err != nil {
+		panic(err)
+	}
+	return wrap
+}
+
+// Load is like LoadHnswWrap, but the error is returned instead of panic.
+// util.ErrCorruptFile is returned if the file is truncated or has invalid content.
+func Load(path string) (*HnswWrap, error) {
 	start := time.Now()
 	file, err := os.Open(path)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	reader := bufio.NewReader(file)
-	efCons := util.ReadValue[int32](reader)
-	ef := util.ReadValue[int32](reader)
-	m := util.ReadValue[int32](reader)
-	m0 := util.ReadValue[int32](reader)
-	normFactor := util.ReadValue[float64](reader)
-	mode := util.ReadValue[int32](reader)
-	entryPointId := util.ReadValue[int32](reader)
-	maxLayer := util.ReadValue[int32](reader)
-	disType := util.ReadValue[int32](reader)
-	docSize := util.ReadValue[int32](reader)
-	d := util.ReadValue[int32](reader)
-	docs := make([]*data.Doc, docSize)
-	for i := int32(0); i < docSize; i++ {
-		vector := make([]float32, d)
-		id := util.ReadValue[int32](reader)
-		for j := int32(0); j < d; j++ {
-			vector[j] = util.ReadValue[float32](reader)
+	defer file.Close()
+	bufReader := bufio.NewReader(file)
+	h, err := hnsw.Load(bufReader)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", path, err)
+	}
+	docs := h.Docs
+	docSize := int32(len(docs))
+	reader := &util.ErrReader{R: bufReader}
+	// readSize reads a size and makes sure it is in [0, limit], 0 is returned if the size is invalid
+	readSize := func(limit int32) int32 {
+		size := util.TryReadValue[int32](reader)
+		if reader.Err == nil && (size < 0 || size > limit) {
+			reader.Err = fmt.Errorf("size [%v] is out of range [0, %v]", size, limit)
 		}
-		docs[i] = &data.Doc{
-			Id:     id,
-			Vector: vector,
+		if reader.Err != nil {
+			return 0
 		}
+		return size
 	}
-	neighbors := make([][][]*hnsw.Neighbor, docSize)
-	for i := int32(0); i < docSize; i++ {
-		layerCnt := util.ReadValue[int32](reader)
-		layers := make([][]*hnsw.Neighbor, layerCnt)
-		for j := int32(0); j < layerCnt; j++ {
-			neighborCnt := util.ReadValue[int32](reader)
-			ns := make([]*hnsw.Neighbor, neighborCnt)
-			for n := int32(0); n < neighborCnt; n++ {
-				id := util.ReadValue[int32](reader)
-				dis := util.ReadValue[float32](reader)
-				ns[n] = &hnsw.Neighbor{
-					Doc: docs[id],
-					Dis: dis,
-				}
-			}
-			layers[j] = ns
+	// readId reads an id and makes sure it is the id of a doc, 0 is returned if the id is invalid
+	readId := func() int32 {
+		id := util.TryReadValue[int32](reader)
+		if reader.Err == nil && (id < 0 || id >= docSize || docs[id] == nil) {
+			reader.Err = fmt.Errorf("id [%v] is not a doc", id)
+		}
+		if reader.Err != nil {
+			return 0
 		}
-		neighbors[i] = layers
+		return id
+	}
+	corrupt := func() (*HnswWrap, error) {
+		return nil, fmt.Errorf("%w: %v: %v", util.ErrCorruptFile, path, reader.Err)
 	}
 
-	nswF := util.ReadValue[int32](reader)
-	nswW := util.ReadValue[int32](reader)
-	nswLinks := make([][]int32, docSize)
-	for i := int32(0); i < docSize; i++ {
-		size := util.ReadValue[int32](reader)
-		link := make([]int32, size)
-		for j := int32(0); j < size; j++ {
-			link[j] = util.ReadValue[int32](reader)
+	var nswIndex *nsw.NSW
+	if util.TryReadValue[int32](reader) != 0 {
+		nswIndex = &nsw.NSW{
+			Docs:    docs,
+			Links:   make([][]int32, docSize),
+			F:       util.TryReadValue[int32](reader),
+			W:       util.TryReadValue[int32](reader),
+			DisType: h.DisType,
+			DisFunc: distance.FuncMap[h.DisType],
+			Rand:    rand.New(rand.NewSource(time.Now().UnixNano())),
+
+			BoundedDisFunc: distance.BoundedFuncMap[h.DisType],
+		}
+		for i := int32(0); i < docSize && reader.Err == nil; i++ {
+			size := readSize(docSize)
+			link := make([]int32, size)
+			for j := int32(0); j < size; j++ {
+				link[j] = readId()
+			}
+			nswIndex.Links[i] = link
 		}
-		nswLinks[i] = link
 	}
 
-	testDataSize := util.ReadValue[int32](reader)
-	d = util.ReadValue[int32](reader)
+	testDataSize := readSize(1 << 30)
+	d := readSize(1 << 20)
+	if reader.Err != nil {
+		return corrupt()
+	}
 	testData := make([]*data.Doc, testDataSize)
-	for i := int32(0); i < testDataSize; i++ {
+	for i := int32(0); i < testDataSize && reader.Err == nil; i++ {
 		vector := make([]float32, d)
-		id := util.ReadValue[int32](reader)
+		id := util.TryReadValue[int32](reader)
 		for j := int32(0); j < d; j++ {
-			vector[j] = util.ReadValue[float32](reader)
+			vector[j] = util.TryReadValue[float32](reader)
 		}
 		testData[i] = &data.Doc{
 			Id:     id,
@@ -168,45 +191,26 @@ func LoadHnswWrap(path string) *HnswWrap {
 		}
 	}
 	topK := make([][]*data.Doc, testDataSize)
-	for i := int32(0); i < testDataSize; i++ {
-		size := util.ReadValue[int32](reader)
+	for i := int32(0); i < testDataSize && reader.Err == nil; i++ {
+		size := readSize(docSize)
 		arr := make([]*data.Doc, size)
 		for j := int32(0); j < size; j++ {
-			arr[j] = docs[util.ReadValue[int32](reader)]
+			arr[j] = docs[readId()]
 		}
 		topK[i] = arr
 	}
+	if reader.Err != nil {
+		return corrupt()
+	}
 
-	err = file.Close()
-	if err != nil {
-		panic(err)
+	if err = file.Close(); err != nil {
+		return nil, err
 	}
 	fmt.Printf("load hnsw index cost: [%v]\n", time.Since(start))
-
 	return &HnswWrap{
-		Hnsw: &hnsw.HNSW{
-			Docs:       docs,
-			EfCons:     efCons,
-			Ef:         ef,
-			M:          m,
-			M0:         m0,
-			NormFactor: normFactor,
-			Mode:       hnsw.Mode(mode),
-			Neighbors:  neighbors,
-			EntryPoint: docs[entryPointId],
-			MaxLayer:   maxLayer,
-			Rand:       rand.New(rand.NewSource(time.Now().UnixNano())),
-			DisType:    distance.Type(disType),
-			DisFunc:    distance.FuncMap[distance.Type(disType)],
-		},
-		Nsw: &nsw.NSW{
-			Docs:    docs,
-			Links:   nswLinks,
-			F:       nswF,
-			W:       nswW,
-			DisFunc: distance.FuncMap[distance.Type(disType)],
-		},
+		Hnsw:     h,
+		Nsw:      nswIndex,
 		TestData: testData,
 		TopK:     topK,
-	}
+	}, nil
 }
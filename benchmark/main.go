@@ -14,21 +14,37 @@ import (
 )
 
 func buildHnsw() {
-	docs := data.BuildAllDoc(int32(*dim), int32(*dataCount))
-	hnswIdx := hnsw.BuildHNSW(int32(*hnswM), int32(*hnswEfCons), hnsw.Mode(*hnswMode), disType)
-	start, s1 := time.Now(), time.Now()
-	for i, doc := range docs {
-		hnswIdx.Insert(doc)
-		if (i+1)%10000 == 0 {
-			fmt.Printf("HNSW index insert count: [%v], cost time: [%v]\n", i+1, time.Since(s1))
-			s1 = time.Now()
-		}
+	if *seed == 0 {
+		*seed = time.Now().UnixMicro()
+	}
+	docs := data.BuildAllDocWithSeed(int32(*dim), int32(*dataCount), *seed)
+	start, lastCost := time.Now(), time.Duration(0)
+	hnswIdx, err := hnsw.BuildFromDocs(docs, hnsw.BuildOptions{
+		M:       int32(*hnswM),
+		EfCons:  int32(*hnswEfCons),
+		Mode:    hnsw.Mode(*hnswMode),
+		DisType: disType,
+		Seed:    *seed,
+		// normalize vectors for the cosine distance
+		Normalize: *hnswNormalize,
+		Heuristic: &hnsw.HeuristicOptions{
+			ExtendCandidates:      *hnswExtendCandidates,
+			KeepPrunedConnections: *hnswKeepPruned,
+			Alpha:                 float32(*hnswAlpha),
+		},
+		Progress: func(inserted int, cost time.Duration) {
+			fmt.Printf("HNSW index insert count: [%v], cost time: [%v]\n", inserted, cost-lastCost)
+			lastCost = cost
+		},
+	}, *hnswBuildWorkers)
+	if err != nil {
+		panic(err)
 	}
 	fmt.Printf("HNSW build index cost time: [%v]\n", time.Since(start))
 	fmt.Printf("HNSW insertion avg compution cnt: [%v]\n", int(hnswIdx.ComputeCnt)/len(docs))
 
-	nswIdx := nsw.BuildNSW(docs, int32(*nswF), int32(*nswW), disType)
-	testDocs := data.BuildAllDoc(int32(*dim), int32(*testCount))
+	nswIdx := nsw.BuildNSWWithSeed(docs, int32(*nswF), int32(*nswW), disType, *seed)
+	testDocs := data.BuildAllDocWithSeed(int32(*dim), int32(*testCount), *seed+1)
 	bfRes := testBruteForce(docs, testDocs)
 	wrap := &hnsw_wrap.HnswWrap{
 		Hnsw:     hnswIdx,
@@ -42,6 +58,9 @@ func buildHnsw() {
 func testHnsw() {
 	wrap := hnsw_wrap.LoadHnswWrap(*hnswFilaPath)
 	wrap.Hnsw.Ef = int32(*hnswEf)
+	if *hnswTargetRecall > 0 {
+		tuneEf(wrap.Hnsw, int32(len(wrap.TestData[0].Vector)))
+	}
 	hnswRes, nswRes := [][]*data.Doc{}, [][]*data.Doc{}
 	start := time.Now()
 	for _, doc := range wrap.TestData {
@@ -56,9 +75,17 @@ func testHnsw() {
 	fmt.Printf("NSW query avg compution cnt: [%v]\n", int(wrap.Nsw.ComputeCnt)/len(wrap.TestData))
 	wrap.Nsw.Stat()
 
+	searchKNN, computeCnt := wrap.Hnsw.SearchKNN, &wrap.Hnsw.ComputeCnt
+	if *hnswFlat {
+		flatIdx, err := wrap.Hnsw.Flatten()
+		if err != nil {
+			panic(err)
+		}
+		searchKNN, computeCnt = flatIdx.SearchKNN, &flatIdx.ComputeCnt
+	}
 	start = time.Now()
 	for _, doc := range wrap.TestData {
-		knn := wrap.Hnsw.SearchKNN(doc.Vector, int32(*hnswEf), int32(*k), int32(*hnswIgnoreLayer))
+		knn := searchKNN(doc.Vector, wrap.Hnsw.Ef, int32(*k), int32(*hnswIgnoreLayer))
 		hnswRes = append(hnswRes, knn)
 	}
 	cost = time.Since(start).Milliseconds()
@@ -66,10 +93,26 @@ func testHnsw() {
 	compare(wrap.TopK, hnswRes)
 	fmt.Printf("HNSW query performance: [%.2f ms / query], ", float64(cost)/float64(len(wrap.TestData)))
 	fmt.Printf("[%0.f queries / second]\n", 1000*float64(len(wrap.TestData))/float64(cost))
-	fmt.Printf("HNSW query avg compution cnt: [%v]\n", int(wrap.Hnsw.ComputeCnt)/len(wrap.TestData))
+	fmt.Printf("HNSW query avg compution cnt: [%v]\n", int(*computeCnt)/len(wrap.TestData))
 	wrap.Hnsw.Stat()
 }
 
+// tuneEf sets the ef of h to the smallest one hitting -hnsw_target_recall on random queries.
+func tuneEf(h *hnsw.HNSW, dim int32) {
+	queries := [][]float32{}
+	for _, doc := range data.BuildAllDoc(dim, int32(*hnswTuneCount)) {
+		queries = append(queries, doc.Vector)
+	}
+	ef, err := h.TuneEf(queries, int32(*k), *hnswTargetRecall)
+	if err != nil {
+		panic(err)
+	}
+	for _, point := range h.EfCurve {
+		fmt.Printf("ef: [%v],	recall rate: [%.4f%%],	latency: [%v]\n", point.Ef, 100*point.Recall, point.Latency)
+	}
+	fmt.Printf("HNSW tuned ef: [%v]\n", ef)
+}
+
 func testBruteForce(docs, testDocs []*data.Doc) [][]*data.Doc {
 	start := time.Now()
 	bf := &brute_force.Searcher{Docs: docs}
@@ -101,16 +144,19 @@ func compare(res1, res2 [][]*data.Doc) {
 	fmt.Printf("recall rate: [%.4f%%]\n", 100*float64(hitCount)/float64(allCount))
 }
 
-const (
+var (
+	// distance.Type of the indexes
 	disType = distance.L2
-)
+	// name of a registered distance: l2, cosine or inner_product
+	disTypeFlag = flag.String("dis_type", "l2", "")
 
-var (
 	dim       = flag.Int("d", 8, "")
 	k         = flag.Int("k", 10, "")
 	dataCount = flag.Int("count", 100000, "")
 	testCount = flag.Int("test_count", 1000, "")
 	operation = flag.String("operation", "", "")
+	// seed of data generation and index construction, 0 means seeded by current time
+	seed = flag.Int64("seed", 0, "")
 
 	nswF = flag.Int("nsw_f", 20, "")
 	nswW = flag.Int("nsw_w", 2, "")
@@ -122,10 +168,28 @@ var (
 	hnswMode        = flag.Int("hnsw_mode", 1, "")
 	hnswFilaPath    = flag.String("hnsw_file_path", "./hnsw_8d.data", "")
 	hnswIgnoreLayer = flag.Int("hnsw_ignore_layer", 0, "")
+	// 0 means runtime.NumCPU()
+	hnswBuildWorkers = flag.Int("hnsw_build_workers", 0, "")
+	// options of the heuristic neighbor selection
+	hnswExtendCandidates = flag.Bool("hnsw_extend_candidates", false, "")
+	hnswKeepPruned       = flag.Bool("hnsw_keep_pruned", true, "")
+	hnswAlpha            = flag.Float64("hnsw_alpha", 1, "")
+	// only for the cosine distance
+	hnswNormalize = flag.Bool("hnsw_normalize", false, "")
+	// tune ef on hnsw_tune_count random queries to hit the recall if positive, instead of using hnsw_ef
+	hnswTargetRecall = flag.Float64("hnsw_target_recall", 0, "")
+	hnswTuneCount    = flag.Int("hnsw_tune_count", 100, "")
+	// search with a flat snapshot of the index
+	hnswFlat = flag.Bool("hnsw_flat", false, "")
 )
 
 func main() {
 	flag.Parse()
+	var ok bool
+	if disType, ok = distance.Lookup(*disTypeFlag); !ok {
+		panic(fmt.Sprintf("unknown distance: [%v]", *disTypeFlag))
+	}
+	fmt.Printf("distance kernels: [%v]\n", distance.KernelName())
 
 	if *operation == "only_build" {
 		buildHnsw()
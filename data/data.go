@@ -13,6 +13,17 @@ const (
 type Doc struct {
 	Id     int32
 	Vector []float32
+	// attributes of the doc, e.g. the encoded title, url and tags. It is opaque to the indexes,
+	// and returned along with the doc by searches
+	Payload []byte
+}
+
+// MultiDoc is a doc with multiple vectors, e.g. the embeddings of its passages.
+type MultiDoc struct {
+	Id      int32
+	Vectors [][]float32
+	// shared by the docs of all vectors, see Doc.Payload
+	Payload []byte
 }
 
 type Element struct {
@@ -24,11 +35,64 @@ func (e *Element) GetValue() float32 {
 	return e.Distance
 }
 
+// Result is a doc found by a search, with its distance to the query and the similarity score derived from the distance.
+type Result struct {
+	Doc      *Doc
+	Distance float32
+	Score    float32
+}
+
+// ResultDocs strips distances and scores from results.
+func ResultDocs(results []*Result) []*Doc {
+	if results == nil {
+		return nil
+	}
+	docs := make([]*Doc, len(results))
+	for i, r := range results {
+		docs[i] = r.Doc
+	}
+	return docs
+}
+
+// SearchStats is the work done by a search.
+type SearchStats struct {
+	// number of distance computations
+	ComputeCnt int64
+	// layer id -> number of docs visited at the layer
+	VisitedCnt []int64
+	// number of docs whose neighbors are expanded
+	HopCnt int64
+	// number of pushes and pops of the candidate and result heaps
+	HeapOpCnt int64
+	// whether the search was stopped by its time budget
+	TimedOut bool
+	Cost     time.Duration
+}
+
+// AddLayer adds the work done at layer to s.
+func (s *SearchStats) AddLayer(layer int32, visitedCnt, hopCnt, heapOpCnt int64) {
+	for int32(len(s.VisitedCnt)) <= layer {
+		s.VisitedCnt = append(s.VisitedCnt, 0)
+	}
+	s.VisitedCnt[layer] += visitedCnt
+	s.HopCnt += hopCnt
+	s.HeapOpCnt += heapOpCnt
+}
+
 var (
 	random = rand.New(rand.NewSource(time.Now().UnixMicro()))
 )
 
 func BuildAllDoc(dim, count int32) []*Doc {
+	return buildAllDoc(dim, count, random)
+}
+
+// BuildAllDocWithSeed is like BuildAllDoc, but the vectors are generated by a random source of seed.
+func BuildAllDocWithSeed(dim, count int32, seed int64) []*Doc {
+	return buildAllDoc(dim, count, rand.New(rand.NewSource(seed)))
+}
+
+func buildAllDoc(dim, count int32, r *rand.Rand) []*Doc {
 	if dim < 1 {
 		dim = defaultDim
 	}
@@ -37,15 +101,19 @@ func BuildAllDoc(dim, count int32) []*Doc {
 	}
 	Docs := make([]*Doc, count)
 	for i := 0; i < len(Docs); i++ {
-		Docs[i] = BuildDoc(int32(i), dim)
+		Docs[i] = buildDoc(int32(i), dim, r)
 	}
 	return Docs
 }
 
 func BuildDoc(id, dim int32) *Doc {
+	return buildDoc(id, dim, random)
+}
+
+func buildDoc(id, dim int32, r *rand.Rand) *Doc {
 	vector := make([]float32, dim)
 	for i := 0; i < len(vector); i++ {
-		vector[i] = random.Float32()
+		vector[i] = r.Float32()
 	}
 	return &Doc{Id: id, Vector: vector}
 }
@@ -0,0 +1,52 @@
+package distance
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+)
+
+// BinaryVector is a bit-packed binary vector, e.g. a 256-bit hash code takes 4 words. Bit i is bit i%64 of
+// word i/64.
+type BinaryVector []uint64
+
+// Pack returns the bits of v in float32 words, 32 bits per word, which is the Vector of a doc indexed with the
+// Hamming distance. So a binary vector takes 1/32 of the memory of one float32 per bit, and the indexes store
+// and persist it like any other vector. The words are only meaningful to HammingDistance.
+func (v BinaryVector) Pack() []float32 {
+	vec := make([]float32, 2*len(v))
+	for i, word := range v {
+		vec[2*i] = math.Float32frombits(uint32(word))
+		vec[2*i+1] = math.Float32frombits(uint32(word >> 32))
+	}
+	return vec
+}
+
+// UnpackBinary returns the binary vector packed in vec by BinaryVector.Pack, the bits of an odd last word are
+// the lower bits of the last word of the binary vector.
+func UnpackBinary(vec []float32) BinaryVector {
+	v := make(BinaryVector, (len(vec)+1)/2)
+	for i, word := range vec {
+		v[i/2] |= uint64(math.Float32bits(word)) << (32 * (i % 2))
+	}
+	return v
+}
+
+// HammingDistance returns the number of different bits of two packed binary vectors, see BinaryVector.Pack.
+func HammingDistance(vec1, vec2 []float32) float32 {
+	if len(vec2) != len(vec1) {
+		panic(fmt.Sprintf("vec1 dim: [%v] != vec2 dim: [%v]", len(vec1), len(vec2)))
+	}
+	dis := 0
+	i := 0
+	// two words at a time, so that a popcount covers 64 bits
+	for ; i+1 < len(vec1); i += 2 {
+		x1 := math.Float32bits(vec1[i]) ^ math.Float32bits(vec2[i])
+		x2 := math.Float32bits(vec1[i+1]) ^ math.Float32bits(vec2[i+1])
+		dis += bits.OnesCount64(uint64(x1) | uint64(x2)<<32)
+	}
+	if i < len(vec1) {
+		dis += bits.OnesCount32(math.Float32bits(vec1[i]) ^ math.Float32bits(vec2[i]))
+	}
+	return float32(dis)
+}
@@ -2,28 +2,144 @@ package distance
 
 import (
 	"fmt"
+	"math"
+
+	"github.com/shiyinong/hnsw-go/util"
 )
 
 type Type int32
 
+// Similarity metrics are turned into distances, so that lower is always better for the indexes,
+// and ScoreFuncMap turns them back.
 const (
 	L2 Type = 0
+	// 1 - cosine similarity
+	Cosine Type = 1
+	// negative inner product
+	InnerProduct Type = 2
+	// number of different bits of binary vectors, see BinaryVector
+	Hamming Type = 3
 )
 
 var (
 	FuncMap = map[Type]func(vec1, vec2 []float32) float32{
-		L2: L2Distance,
+		L2:           L2Distance,
+		Cosine:       CosineDistance,
+		InnerProduct: InnerProductDistance,
+		Hamming:      HammingDistance,
+	}
+	// bounded variants of FuncMap, the distances of similarity metrics can not be abandoned early
+	BoundedFuncMap = map[Type]BoundedFunc{
+		L2:           L2DistanceBounded,
+		Cosine:       Unbounded(CosineDistance),
+		InnerProduct: Unbounded(InnerProductDistance),
+		Hamming:      Unbounded(HammingDistance),
+	}
+	// maps a distance to a similarity score, higher is more similar
+	ScoreFuncMap = map[Type]func(dis float32) float32{
+		L2:           L2Score,
+		Cosine:       CosineScore,
+		InnerProduct: InnerProductScore,
+		Hamming:      L2Score,
 	}
 )
 
+// BoundedFunc is a distance function which stops early once the distance is known to be greater than bound.
+// It returns the exact distance if the distance is not greater than bound, otherwise any value greater than bound.
+type BoundedFunc func(vec1, vec2 []float32, bound float32) float32
+
+// Unbounded turns disFunc into a BoundedFunc which always computes the exact distance, it is for the distances
+// whose partial sums are not monotonic, like the inner product.
+func Unbounded(disFunc func(vec1, vec2 []float32) float32) BoundedFunc {
+	return func(vec1, vec2 []float32, _ float32) float32 {
+		return disFunc(vec1, vec2)
+	}
+}
+
+// CheckDimension returns util.ErrDimensionMismatch if vec1 and vec2 have different dimensions.
+func CheckDimension(vec1, vec2 []float32) error {
+	if len(vec2) != len(vec1) {
+		return fmt.Errorf("%w: vec1 dim: [%v] != vec2 dim: [%v]", util.ErrDimensionMismatch, len(vec1), len(vec2))
+	}
+	return nil
+}
+
 func L2Distance(vec1, vec2 []float32) float32 {
 	if len(vec2) != len(vec1) {
 		panic(fmt.Sprintf("vec1 dim: [%v] != vec2 dim: [%v]", len(vec1), len(vec2)))
 	}
-	s := float32(0)
-	for i := range vec1 {
-		diff := vec1[i] - vec2[i]
-		s += diff * diff
+	return kernels.l2(vec1, vec2, math.MaxFloat32)
+}
+
+// L2DistanceBounded is the BoundedFunc of L2Distance, the partial sum is checked every 64 dimensions, so that
+// most of a far vector is skipped in high dimensions.
+func L2DistanceBounded(vec1, vec2 []float32, bound float32) float32 {
+	if len(vec2) != len(vec1) {
+		panic(fmt.Sprintf("vec1 dim: [%v] != vec2 dim: [%v]", len(vec1), len(vec2)))
+	}
+	return kernels.l2(vec1, vec2, bound)
+}
+
+// L2Score maps the squared L2 distance to a similarity score in (0, 1].
+func L2Score(dis float32) float32 {
+	return 1 / (1 + dis)
+}
+
+// CosineDistance returns 1 - cosine similarity of vec1 and vec2, in [0, 2]. A zero vector has distance 1 to
+// every vector.
+func CosineDistance(vec1, vec2 []float32) float32 {
+	if len(vec2) != len(vec1) {
+		panic(fmt.Sprintf("vec1 dim: [%v] != vec2 dim: [%v]", len(vec1), len(vec2)))
+	}
+	dot, norm1, norm2 := kernels.cosine(vec1, vec2)
+	if norm1 == 0 || norm2 == 0 {
+		return 1
+	}
+	return 1 - dot/float32(math.Sqrt(float64(norm1)*float64(norm2)))
+}
+
+// NormalizedCosineDistance is CosineDistance of unit vectors, which is 1 - inner product.
+func NormalizedCosineDistance(vec1, vec2 []float32) float32 {
+	return 1 + InnerProductDistance(vec1, vec2)
+}
+
+// CosineScore maps the cosine distance back to the cosine similarity in [-1, 1].
+func CosineScore(dis float32) float32 {
+	return 1 - dis
+}
+
+// InnerProductDistance returns the negative inner product of vec1 and vec2.
+func InnerProductDistance(vec1, vec2 []float32) float32 {
+	if len(vec2) != len(vec1) {
+		panic(fmt.Sprintf("vec1 dim: [%v] != vec2 dim: [%v]", len(vec1), len(vec2)))
+	}
+	return -kernels.dot(vec1, vec2)
+}
+
+// InnerProductScore maps the inner product distance back to the inner product.
+func InnerProductScore(dis float32) float32 {
+	return -dis
+}
+
+// Normalize returns a copy of vec scaled to unit length, a zero vector is copied as it is.
+func Normalize(vec []float32) []float32 {
+	normalized := make([]float32, len(vec))
+	NormalizeTo(normalized, vec)
+	return normalized
+}
+
+// NormalizeTo writes vec scaled to unit length to dst, which should have the same length as vec.
+func NormalizeTo(dst, vec []float32) {
+	norm := float32(0)
+	for _, v := range vec {
+		norm += v * v
+	}
+	if norm == 0 {
+		copy(dst, vec)
+		return
+	}
+	scale := float32(1 / math.Sqrt(float64(norm)))
+	for i, v := range vec {
+		dst[i] = v * scale
 	}
-	return s
 }
@@ -1,10 +1,15 @@
 package distance
 
 import (
+	"errors"
 	"fmt"
+	"math"
+	"math/bits"
+	"math/rand"
 	"testing"
 
 	"github.com/shiyinong/hnsw-go/data"
+	"github.com/shiyinong/hnsw-go/util"
 )
 
 func TestL2Closeness(t *testing.T) {
@@ -14,3 +19,125 @@ func TestL2Closeness(t *testing.T) {
 	dis := L2Distance(v1.Vector, v2.Vector)
 	fmt.Println(dis)
 }
+
+func TestSimilarityDistances(t *testing.T) {
+	vec1, vec2 := []float32{1, 2, 2}, []float32{2, 0, 0}
+	if dis := InnerProductDistance(vec1, vec2); dis != -2 || InnerProductScore(dis) != 2 {
+		t.Fatalf("inner product distance: [%v]", dis)
+	}
+	if dis := CosineDistance(vec1, vec2); math.Abs(float64(dis)-2.0/3) > 1e-6 ||
+		math.Abs(float64(CosineScore(dis))-1.0/3) > 1e-6 {
+		t.Fatalf("cosine distance: [%v]", dis)
+	}
+	if dis := CosineDistance(vec1, []float32{0, 0, 0}); dis != 1 {
+		t.Fatalf("cosine distance to zero vector: [%v]", dis)
+	}
+	normalized := Normalize(vec1)
+	if vec1[0] != 1 {
+		t.Fatalf("vector is modified by Normalize")
+	}
+	if dis := NormalizedCosineDistance(normalized, Normalize(vec2)); math.Abs(float64(dis)-2.0/3) > 1e-6 {
+		t.Fatalf("normalized cosine distance: [%v]", dis)
+	}
+	if zero := Normalize([]float32{0, 0}); zero[0] != 0 || zero[1] != 0 {
+		t.Fatalf("zero vector is normalized to [%v]", zero)
+	}
+}
+
+// registered once per test binary, the registry can not be cleared
+var weightedL2, errRegisterWeightedL2 = Register("weighted_l2", func(vec1, vec2 []float32) float32 {
+	dis := float32(0)
+	for i := range vec1 {
+		diff := vec1[i] - vec2[i]
+		dis += float32(i+1) * diff * diff
+	}
+	return dis
+}, Properties{})
+
+var unitDot, errRegisterUnitDot = Register("unit_dot", func(vec1, vec2 []float32) float32 {
+	return -InnerProductDistance(vec1, vec2)
+}, Properties{IsSimilarity: true, RequiresNormalization: true})
+
+func TestRegister(t *testing.T) {
+	if errRegisterWeightedL2 != nil || errRegisterUnitDot != nil {
+		t.Fatalf("register: [%v], [%v]", errRegisterWeightedL2, errRegisterUnitDot)
+	}
+	for name, expect := range map[string]Type{"l2": L2, "cosine": Cosine, "inner_product": InnerProduct,
+		"weighted_l2": weightedL2, "unit_dot": unitDot} {
+		if got, ok := Lookup(name); !ok || got != expect || got.Name() != name || got.String() != name {
+			t.Fatalf("lookup of [%v]: [%v %v], expect: [%v]", name, got, ok, expect)
+		}
+	}
+	if _, ok := Lookup("unknown"); ok {
+		t.Fatalf("lookup of unknown distance succeeded")
+	}
+	if name := Type(100).String(); name != "Type(100)" {
+		t.Fatalf("name of unregistered type: [%v]", name)
+	}
+	if Cosine.Properties() != (Properties{IsSimilarity: true}) || L2.Properties().IsMetric {
+		t.Fatalf("unexpected properties of builtin distances")
+	}
+
+	vec1, vec2 := []float32{1, 2}, []float32{2, 4}
+	if dis := FuncMap[weightedL2](vec1, vec2); dis != 9 || BoundedFuncMap[weightedL2](vec1, vec2, 1) != 9 ||
+		ScoreFuncMap[weightedL2](dis) != 0.1 {
+		t.Fatalf("weighted l2 distance: [%v]", dis)
+	}
+	// similarities are negated to distances, and scores are the similarities
+	if dis := FuncMap[unitDot](vec1, vec2); dis != -10 || ScoreFuncMap[unitDot](dis) != 10 {
+		t.Fatalf("unit dot distance: [%v]", dis)
+	}
+	if !unitDot.Properties().RequiresNormalization {
+		t.Fatalf("properties of [%v] are lost", unitDot)
+	}
+
+	if _, err := Register("l2", L2Distance, Properties{}); !errors.Is(err, util.ErrDuplicateKey) {
+		t.Fatalf("unexpected error of registering a duplicate name: [%v]", err)
+	}
+	if _, err := Register("", L2Distance, Properties{}); !errors.Is(err, util.ErrInvalidParam) {
+		t.Fatalf("unexpected error of registering an empty name: [%v]", err)
+	}
+	if _, err := Register("nil", nil, Properties{}); !errors.Is(err, util.ErrInvalidParam) {
+		t.Fatalf("unexpected error of registering a nil function: [%v]", err)
+	}
+}
+
+func TestHammingDistance(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for n := 0; n < 6; n++ {
+		v1, v2 := make(BinaryVector, n), make(BinaryVector, n)
+		for i := range v1 {
+			v1[i], v2[i] = r.Uint64(), r.Uint64()
+		}
+		// all ones are NaN words, whose bits must be kept as they are
+		if n > 0 {
+			v1[0] = math.MaxUint64
+		}
+		expect := 0
+		for i := range v1 {
+			expect += bits.OnesCount64(v1[i] ^ v2[i])
+		}
+		vec1, vec2 := v1.Pack(), v2.Pack()
+		if len(vec1) != 2*n {
+			t.Fatalf("packed length: [%v], expect: [%v]", len(vec1), 2*n)
+		}
+		if dis := HammingDistance(vec1, vec2); dis != float32(expect) {
+			t.Fatalf("hamming distance of [%v] words: [%v], expect: [%v]", n, dis, expect)
+		}
+		if dis := FuncMap[Hamming](vec1, vec2); dis != float32(expect) {
+			t.Fatalf("hamming distance of [%v] words: [%v], expect: [%v]", n, dis, expect)
+		}
+		for i, word := range UnpackBinary(vec1) {
+			if word != v1[i] {
+				t.Fatalf("unpacked word [%v]: [%x], expect: [%x]", i, word, v1[i])
+			}
+		}
+	}
+	// an odd number of float32 words
+	if dis := HammingDistance([]float32{math.Float32frombits(7)}, []float32{0}); dis != 3 {
+		t.Fatalf("hamming distance of a single word: [%v]", dis)
+	}
+	if !Hamming.Properties().IsMetric || Hamming.Name() != "hamming" {
+		t.Fatalf("unexpected registration of hamming: [%v] [%+v]", Hamming.Name(), Hamming.Properties())
+	}
+}
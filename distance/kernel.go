@@ -0,0 +1,75 @@
+package distance
+
+// kernelSet is an implementation of the loops of the distance functions. The vectors passed to the kernels
+// always have the same length.
+type kernelSet struct {
+	name string
+	// squared L2 distance, the partial sum is checked every boundedBlockSize dimensions and returned once it
+	// is greater than bound. The sum is the same for every bound it does not exceed
+	l2 func(vec1, vec2 []float32, bound float32) float32
+	// inner product
+	dot func(vec1, vec2 []float32) float32
+	// inner product and squared norms
+	cosine func(vec1, vec2 []float32) (dot, norm1, norm2 float32)
+}
+
+// number of dimensions summed between two checks of the bound by the l2 kernels, it is a multiple of the
+// widths of the SIMD loops
+const boundedBlockSize = 64
+
+var (
+	genericKernels = kernelSet{
+		name:   "generic",
+		l2:     l2Generic,
+		dot:    dotGeneric,
+		cosine: cosineGeneric,
+	}
+	// kernel sets supported by the CPU, SIMD kernel sets are appended by the architecture specific init,
+	// and the last one is used
+	kernelSets = []kernelSet{genericKernels}
+	kernels    = genericKernels
+)
+
+// KernelName returns the name of the kernels used by the distance functions, e.g. "avx2".
+func KernelName() string {
+	return kernels.name
+}
+
+// useKernels appends the supported kernel sets and uses the last one.
+func useKernels(sets ...kernelSet) {
+	kernelSets = append(kernelSets, sets...)
+	kernels = kernelSets[len(kernelSets)-1]
+}
+
+func l2Generic(vec1, vec2 []float32, bound float32) float32 {
+	s := float32(0)
+	for {
+		block1 := vec1[:min(len(vec1), boundedBlockSize)]
+		block2 := vec2[:len(block1)]
+		for i := range block1 {
+			diff := block1[i] - block2[i]
+			s += diff * diff
+		}
+		vec1, vec2 = vec1[len(block1):], vec2[len(block1):]
+		if len(vec1) == 0 || s > bound {
+			return s
+		}
+	}
+}
+
+func dotGeneric(vec1, vec2 []float32) float32 {
+	s := float32(0)
+	for i := range vec1 {
+		s += vec1[i] * vec2[i]
+	}
+	return s
+}
+
+func cosineGeneric(vec1, vec2 []float32) (dot, norm1, norm2 float32) {
+	for i := range vec1 {
+		dot += vec1[i] * vec2[i]
+		norm1 += vec1[i] * vec1[i]
+		norm2 += vec2[i] * vec2[i]
+	}
+	return dot, norm1, norm2
+}
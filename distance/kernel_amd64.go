@@ -0,0 +1,65 @@
+//go:build !purego
+
+package distance
+
+// SSE is part of amd64, AVX2 kernels need FMA as well, and AVX-512 kernels only need AVX512F.
+
+//go:noescape
+func l2SSE(vec1, vec2 []float32, bound float32) float32
+
+//go:noescape
+func dotSSE(vec1, vec2 []float32) float32
+
+//go:noescape
+func cosineSSE(vec1, vec2 []float32) (dot, norm1, norm2 float32)
+
+//go:noescape
+func l2AVX2(vec1, vec2 []float32, bound float32) float32
+
+//go:noescape
+func dotAVX2(vec1, vec2 []float32) float32
+
+//go:noescape
+func cosineAVX2(vec1, vec2 []float32) (dot, norm1, norm2 float32)
+
+//go:noescape
+func l2AVX512(vec1, vec2 []float32, bound float32) float32
+
+//go:noescape
+func dotAVX512(vec1, vec2 []float32) float32
+
+//go:noescape
+func cosineAVX512(vec1, vec2 []float32) (dot, norm1, norm2 float32)
+
+func cpuid(eaxArg, ecxArg uint32) (eax, ebx, ecx, edx uint32)
+
+// xgetbv returns XCR0, which tells the register states saved by the OS.
+func xgetbv() (eax, edx uint32)
+
+func init() {
+	useKernels(kernelSet{name: "sse", l2: l2SSE, dot: dotSSE, cosine: cosineSSE})
+	hasAVX2, hasAVX512 := detectCPU()
+	if hasAVX2 {
+		useKernels(kernelSet{name: "avx2", l2: l2AVX2, dot: dotAVX2, cosine: cosineAVX2})
+	}
+	if hasAVX512 {
+		useKernels(kernelSet{name: "avx512", l2: l2AVX512, dot: dotAVX512, cosine: cosineAVX512})
+	}
+}
+
+func detectCPU() (hasAVX2, hasAVX512 bool) {
+	maxId, _, _, _ := cpuid(0, 0)
+	_, _, ecx1, _ := cpuid(1, 0)
+	// the OS must support XGETBV to save the AVX registers
+	if maxId < 7 || ecx1&(1<<27) == 0 {
+		return false, false
+	}
+	_, ebx7, _, _ := cpuid(7, 0)
+	xcr0, _ := xgetbv()
+	hasAVX, hasFMA := ecx1&(1<<28) != 0, ecx1&(1<<12) != 0
+	// XMM and YMM states
+	hasAVX2 = hasAVX && hasFMA && ebx7&(1<<5) != 0 && xcr0&0x6 == 0x6
+	// opmask and ZMM states as well
+	hasAVX512 = hasAVX2 && ebx7&(1<<16) != 0 && xcr0&0xe6 == 0xe6
+	return hasAVX2, hasAVX512
+}
@@ -0,0 +1,544 @@
+//go:build !purego
+
+#include "textflag.h"
+
+// The kernels take two slices of the same length, the main loops consume whole registers of floats,
+// and the tails are handled by scalar instructions, or by masked loads for AVX-512.
+
+// HSUM_SSE sums up the 4 lanes of X into its lane 0, T is clobbered.
+#define HSUM_SSE(X, T) \
+	MOVHLPS X, T;       \
+	ADDPS   T, X;       \
+	MOVAPS  X, T;       \
+	SHUFPS  $0x55, T, T; \
+	ADDSS   T, X
+
+// HSUM_AVX sums up the 8 lanes of the Y register of X into lane 0 of X, T is clobbered.
+#define HSUM_AVX(Y, X, T) \
+	VEXTRACTF128 $1, Y, T; \
+	VADDPS       T, X, X;  \
+	VMOVHLPS     X, X, T;  \
+	VADDPS       T, X, X;  \
+	VMOVSHDUP    X, T;     \
+	VADDSS       T, X, X
+
+// HSUM_AVX512 sums up the 16 lanes of the Z register of Y and X into lane 0 of X, TY and TX are clobbered.
+#define HSUM_AVX512(Z, Y, X, TY, TX) \
+	VEXTRACTF64X4 $1, Z, TY; \
+	VADDPS        TY, Y, Y;  \
+	HSUM_AVX(Y, X, TX)
+
+// TAIL_MASK sets K1 to the lowest CX bits, CX must be less than 16.
+#define TAIL_MASK \
+	MOVQ  $1, AX;  \
+	SHLQ  CX, AX;  \
+	DECQ  AX;      \
+	KMOVW AX, K1
+
+// func l2SSE(vec1, vec2 []float32, bound float32) float32
+TEXT ·l2SSE(SB), NOSPLIT, $0-60
+	MOVQ  vec1_base+0(FP), SI
+	MOVQ  vec2_base+24(FP), DI
+	MOVQ  vec1_len+8(FP), CX
+	MOVSS bound+48(FP), X6
+	MOVQ  $64, DX
+	XORPS X0, X0
+	XORPS X1, X1
+
+loop8:
+	CMPQ    CX, $8
+	JLT     loop4
+	MOVUPS  (SI), X2
+	MOVUPS  16(SI), X3
+	MOVUPS  (DI), X4
+	MOVUPS  16(DI), X5
+	SUBPS   X4, X2
+	SUBPS   X5, X3
+	MULPS   X2, X2
+	MULPS   X3, X3
+	ADDPS   X2, X0
+	ADDPS   X3, X1
+	ADDQ    $32, SI
+	ADDQ    $32, DI
+	SUBQ    $8, CX
+	SUBQ    $8, DX
+	JNE     loop8
+	MOVQ    $64, DX
+	MOVAPS  X0, X2
+	ADDPS   X1, X2
+	HSUM_SSE(X2, X3)
+	UCOMISS X6, X2
+	JA      abandon
+	JMP     loop8
+
+loop4:
+	ADDPS  X1, X0
+	CMPQ   CX, $4
+	JLT    reduce
+	MOVUPS (SI), X2
+	MOVUPS (DI), X4
+	SUBPS  X4, X2
+	MULPS  X2, X2
+	ADDPS  X2, X0
+	ADDQ   $16, SI
+	ADDQ   $16, DI
+	SUBQ   $4, CX
+
+reduce:
+	HSUM_SSE(X0, X1)
+
+tail:
+	TESTQ CX, CX
+	JEQ   done
+	MOVSS (SI), X2
+	SUBSS (DI), X2
+	MULSS X2, X2
+	ADDSS X2, X0
+	ADDQ  $4, SI
+	ADDQ  $4, DI
+	DECQ  CX
+	JMP   tail
+
+done:
+	MOVSS X0, ret+56(FP)
+	RET
+
+abandon:
+	MOVSS X2, ret+56(FP)
+	RET
+
+// func dotSSE(vec1, vec2 []float32) float32
+TEXT ·dotSSE(SB), NOSPLIT, $0-52
+	MOVQ  vec1_base+0(FP), SI
+	MOVQ  vec2_base+24(FP), DI
+	MOVQ  vec1_len+8(FP), CX
+	XORPS X0, X0
+	XORPS X1, X1
+
+loop8:
+	CMPQ   CX, $8
+	JLT    loop4
+	MOVUPS (SI), X2
+	MOVUPS 16(SI), X3
+	MOVUPS (DI), X4
+	MOVUPS 16(DI), X5
+	MULPS  X4, X2
+	MULPS  X5, X3
+	ADDPS  X2, X0
+	ADDPS  X3, X1
+	ADDQ   $32, SI
+	ADDQ   $32, DI
+	SUBQ   $8, CX
+	JMP    loop8
+
+loop4:
+	ADDPS  X1, X0
+	CMPQ   CX, $4
+	JLT    reduce
+	MOVUPS (SI), X2
+	MOVUPS (DI), X4
+	MULPS  X4, X2
+	ADDPS  X2, X0
+	ADDQ   $16, SI
+	ADDQ   $16, DI
+	SUBQ   $4, CX
+
+reduce:
+	HSUM_SSE(X0, X1)
+
+tail:
+	TESTQ CX, CX
+	JEQ   done
+	MOVSS (SI), X2
+	MULSS (DI), X2
+	ADDSS X2, X0
+	ADDQ  $4, SI
+	ADDQ  $4, DI
+	DECQ  CX
+	JMP   tail
+
+done:
+	MOVSS X0, ret+48(FP)
+	RET
+
+// func cosineSSE(vec1, vec2 []float32) (dot, norm1, norm2 float32)
+TEXT ·cosineSSE(SB), NOSPLIT, $0-60
+	MOVQ  vec1_base+0(FP), SI
+	MOVQ  vec2_base+24(FP), DI
+	MOVQ  vec1_len+8(FP), CX
+	XORPS X0, X0
+	XORPS X1, X1
+	XORPS X2, X2
+
+loop4:
+	CMPQ   CX, $4
+	JLT    reduce
+	MOVUPS (SI), X3
+	MOVUPS (DI), X4
+	MOVAPS X3, X5
+	MULPS  X4, X5
+	ADDPS  X5, X0
+	MULPS  X3, X3
+	ADDPS  X3, X1
+	MULPS  X4, X4
+	ADDPS  X4, X2
+	ADDQ   $16, SI
+	ADDQ   $16, DI
+	SUBQ   $4, CX
+	JMP    loop4
+
+reduce:
+	HSUM_SSE(X0, X5)
+	HSUM_SSE(X1, X5)
+	HSUM_SSE(X2, X5)
+
+tail:
+	TESTQ CX, CX
+	JEQ   done
+	MOVSS (SI), X3
+	MOVSS (DI), X4
+	MOVSS X3, X5
+	MULSS X4, X5
+	ADDSS X5, X0
+	MULSS X3, X3
+	ADDSS X3, X1
+	MULSS X4, X4
+	ADDSS X4, X2
+	ADDQ  $4, SI
+	ADDQ  $4, DI
+	DECQ  CX
+	JMP   tail
+
+done:
+	MOVSS X0, dot+48(FP)
+	MOVSS X1, norm1+52(FP)
+	MOVSS X2, norm2+56(FP)
+	RET
+
+// func l2AVX2(vec1, vec2 []float32, bound float32) float32
+TEXT ·l2AVX2(SB), NOSPLIT, $0-60
+	MOVQ   vec1_base+0(FP), SI
+	MOVQ   vec2_base+24(FP), DI
+	MOVQ   vec1_len+8(FP), CX
+	VMOVSS bound+48(FP), X6
+	MOVQ   $64, DX
+	VXORPS Y0, Y0, Y0
+	VXORPS Y1, Y1, Y1
+
+loop16:
+	CMPQ        CX, $16
+	JLT         loop8
+	VMOVUPS     (SI), Y2
+	VMOVUPS     32(SI), Y3
+	VSUBPS      (DI), Y2, Y2
+	VSUBPS      32(DI), Y3, Y3
+	VFMADD231PS Y2, Y2, Y0
+	VFMADD231PS Y3, Y3, Y1
+	ADDQ        $64, SI
+	ADDQ        $64, DI
+	SUBQ        $16, CX
+	SUBQ        $16, DX
+	JNE         loop16
+	MOVQ        $64, DX
+	VADDPS      Y1, Y0, Y2
+	HSUM_AVX(Y2, X2, X3)
+	VUCOMISS    X6, X2
+	JA          abandon
+	JMP         loop16
+
+loop8:
+	VADDPS      Y1, Y0, Y0
+	CMPQ        CX, $8
+	JLT         reduce
+	VMOVUPS     (SI), Y2
+	VSUBPS      (DI), Y2, Y2
+	VFMADD231PS Y2, Y2, Y0
+	ADDQ        $32, SI
+	ADDQ        $32, DI
+	SUBQ        $8, CX
+
+reduce:
+	HSUM_AVX(Y0, X0, X1)
+
+tail:
+	TESTQ       CX, CX
+	JEQ         done
+	VMOVSS      (SI), X2
+	VSUBSS      (DI), X2, X2
+	VFMADD231SS X2, X2, X0
+	ADDQ        $4, SI
+	ADDQ        $4, DI
+	DECQ        CX
+	JMP         tail
+
+done:
+	VZEROUPPER
+	MOVSS X0, ret+56(FP)
+	RET
+
+abandon:
+	VZEROUPPER
+	MOVSS X2, ret+56(FP)
+	RET
+
+// func dotAVX2(vec1, vec2 []float32) float32
+TEXT ·dotAVX2(SB), NOSPLIT, $0-52
+	MOVQ   vec1_base+0(FP), SI
+	MOVQ   vec2_base+24(FP), DI
+	MOVQ   vec1_len+8(FP), CX
+	VXORPS Y0, Y0, Y0
+	VXORPS Y1, Y1, Y1
+
+loop16:
+	CMPQ        CX, $16
+	JLT         loop8
+	VMOVUPS     (SI), Y2
+	VMOVUPS     32(SI), Y3
+	VFMADD231PS (DI), Y2, Y0
+	VFMADD231PS 32(DI), Y3, Y1
+	ADDQ        $64, SI
+	ADDQ        $64, DI
+	SUBQ        $16, CX
+	JMP         loop16
+
+loop8:
+	VADDPS      Y1, Y0, Y0
+	CMPQ        CX, $8
+	JLT         reduce
+	VMOVUPS     (SI), Y2
+	VFMADD231PS (DI), Y2, Y0
+	ADDQ        $32, SI
+	ADDQ        $32, DI
+	SUBQ        $8, CX
+
+reduce:
+	HSUM_AVX(Y0, X0, X1)
+
+tail:
+	TESTQ       CX, CX
+	JEQ         done
+	VMOVSS      (SI), X2
+	VFMADD231SS (DI), X2, X0
+	ADDQ        $4, SI
+	ADDQ        $4, DI
+	DECQ        CX
+	JMP         tail
+
+done:
+	VZEROUPPER
+	MOVSS X0, ret+48(FP)
+	RET
+
+// func cosineAVX2(vec1, vec2 []float32) (dot, norm1, norm2 float32)
+TEXT ·cosineAVX2(SB), NOSPLIT, $0-60
+	MOVQ   vec1_base+0(FP), SI
+	MOVQ   vec2_base+24(FP), DI
+	MOVQ   vec1_len+8(FP), CX
+	VXORPS Y0, Y0, Y0
+	VXORPS Y1, Y1, Y1
+	VXORPS Y2, Y2, Y2
+
+loop8:
+	CMPQ        CX, $8
+	JLT         reduce
+	VMOVUPS     (SI), Y3
+	VMOVUPS     (DI), Y4
+	VFMADD231PS Y4, Y3, Y0
+	VFMADD231PS Y3, Y3, Y1
+	VFMADD231PS Y4, Y4, Y2
+	ADDQ        $32, SI
+	ADDQ        $32, DI
+	SUBQ        $8, CX
+	JMP         loop8
+
+reduce:
+	HSUM_AVX(Y0, X0, X5)
+	HSUM_AVX(Y1, X1, X5)
+	HSUM_AVX(Y2, X2, X5)
+
+tail:
+	TESTQ       CX, CX
+	JEQ         done
+	VMOVSS      (SI), X3
+	VMOVSS      (DI), X4
+	VFMADD231SS X4, X3, X0
+	VFMADD231SS X3, X3, X1
+	VFMADD231SS X4, X4, X2
+	ADDQ        $4, SI
+	ADDQ        $4, DI
+	DECQ        CX
+	JMP         tail
+
+done:
+	VZEROUPPER
+	MOVSS X0, dot+48(FP)
+	MOVSS X1, norm1+52(FP)
+	MOVSS X2, norm2+56(FP)
+	RET
+
+// func l2AVX512(vec1, vec2 []float32, bound float32) float32
+TEXT ·l2AVX512(SB), NOSPLIT, $0-60
+	MOVQ   vec1_base+0(FP), SI
+	MOVQ   vec2_base+24(FP), DI
+	MOVQ   vec1_len+8(FP), CX
+	VMOVSS bound+48(FP), X6
+	MOVQ   $64, DX
+	VPXORD Z0, Z0, Z0
+	VPXORD Z1, Z1, Z1
+
+loop32:
+	CMPQ        CX, $32
+	JLT         loop16
+	VMOVUPS     (SI), Z2
+	VMOVUPS     64(SI), Z3
+	VSUBPS      (DI), Z2, Z2
+	VSUBPS      64(DI), Z3, Z3
+	VFMADD231PS Z2, Z2, Z0
+	VFMADD231PS Z3, Z3, Z1
+	ADDQ        $128, SI
+	ADDQ        $128, DI
+	SUBQ        $32, CX
+	SUBQ        $32, DX
+	JNE         loop32
+	MOVQ        $64, DX
+	VADDPS      Z1, Z0, Z2
+	HSUM_AVX512(Z2, Y2, X2, Y3, X3)
+	VUCOMISS    X6, X2
+	JA          abandon
+	JMP         loop32
+
+loop16:
+	VADDPS      Z1, Z0, Z0
+	CMPQ        CX, $16
+	JLT         tail
+	VMOVUPS     (SI), Z2
+	VSUBPS      (DI), Z2, Z2
+	VFMADD231PS Z2, Z2, Z0
+	ADDQ        $64, SI
+	ADDQ        $64, DI
+	SUBQ        $16, CX
+
+tail:
+	TESTQ       CX, CX
+	JEQ         reduce
+	TAIL_MASK
+	VMOVUPS.Z   (SI), K1, Z2
+	VMOVUPS.Z   (DI), K1, Z3
+	VSUBPS      Z3, Z2, Z2
+	VFMADD231PS Z2, Z2, Z0
+
+reduce:
+	HSUM_AVX512(Z0, Y0, X0, Y1, X1)
+	VZEROUPPER
+	MOVSS X0, ret+56(FP)
+	RET
+
+abandon:
+	VZEROUPPER
+	MOVSS X2, ret+56(FP)
+	RET
+
+// func dotAVX512(vec1, vec2 []float32) float32
+TEXT ·dotAVX512(SB), NOSPLIT, $0-52
+	MOVQ   vec1_base+0(FP), SI
+	MOVQ   vec2_base+24(FP), DI
+	MOVQ   vec1_len+8(FP), CX
+	VPXORD Z0, Z0, Z0
+	VPXORD Z1, Z1, Z1
+
+loop32:
+	CMPQ        CX, $32
+	JLT         loop16
+	VMOVUPS     (SI), Z2
+	VMOVUPS     64(SI), Z3
+	VFMADD231PS (DI), Z2, Z0
+	VFMADD231PS 64(DI), Z3, Z1
+	ADDQ        $128, SI
+	ADDQ        $128, DI
+	SUBQ        $32, CX
+	JMP         loop32
+
+loop16:
+	VADDPS      Z1, Z0, Z0
+	CMPQ        CX, $16
+	JLT         tail
+	VMOVUPS     (SI), Z2
+	VFMADD231PS (DI), Z2, Z0
+	ADDQ        $64, SI
+	ADDQ        $64, DI
+	SUBQ        $16, CX
+
+tail:
+	TESTQ       CX, CX
+	JEQ         reduce
+	TAIL_MASK
+	VMOVUPS.Z   (SI), K1, Z2
+	VMOVUPS.Z   (DI), K1, Z3
+	VFMADD231PS Z3, Z2, Z0
+
+reduce:
+	HSUM_AVX512(Z0, Y0, X0, Y1, X1)
+	VZEROUPPER
+	MOVSS X0, ret+48(FP)
+	RET
+
+// func cosineAVX512(vec1, vec2 []float32) (dot, norm1, norm2 float32)
+TEXT ·cosineAVX512(SB), NOSPLIT, $0-60
+	MOVQ   vec1_base+0(FP), SI
+	MOVQ   vec2_base+24(FP), DI
+	MOVQ   vec1_len+8(FP), CX
+	VPXORD Z0, Z0, Z0
+	VPXORD Z1, Z1, Z1
+	VPXORD Z2, Z2, Z2
+
+loop16:
+	CMPQ        CX, $16
+	JLT         tail
+	VMOVUPS     (SI), Z3
+	VMOVUPS     (DI), Z4
+	VFMADD231PS Z4, Z3, Z0
+	VFMADD231PS Z3, Z3, Z1
+	VFMADD231PS Z4, Z4, Z2
+	ADDQ        $64, SI
+	ADDQ        $64, DI
+	SUBQ        $16, CX
+	JMP         loop16
+
+tail:
+	TESTQ       CX, CX
+	JEQ         reduce
+	TAIL_MASK
+	VMOVUPS.Z   (SI), K1, Z3
+	VMOVUPS.Z   (DI), K1, Z4
+	VFMADD231PS Z4, Z3, Z0
+	VFMADD231PS Z3, Z3, Z1
+	VFMADD231PS Z4, Z4, Z2
+
+reduce:
+	HSUM_AVX512(Z0, Y0, X0, Y5, X5)
+	HSUM_AVX512(Z1, Y1, X1, Y5, X5)
+	HSUM_AVX512(Z2, Y2, X2, Y5, X5)
+	VZEROUPPER
+	MOVSS X0, dot+48(FP)
+	MOVSS X1, norm1+52(FP)
+	MOVSS X2, norm2+56(FP)
+	RET
+
+// func cpuid(eaxArg, ecxArg uint32) (eax, ebx, ecx, edx uint32)
+TEXT ·cpuid(SB), NOSPLIT, $0-24
+	MOVL eaxArg+0(FP), AX
+	MOVL ecxArg+4(FP), CX
+	CPUID
+	MOVL AX, eax+8(FP)
+	MOVL BX, ebx+12(FP)
+	MOVL CX, ecx+16(FP)
+	MOVL DX, edx+20(FP)
+	RET
+
+// func xgetbv() (eax, edx uint32)
+TEXT ·xgetbv(SB), NOSPLIT, $0-8
+	MOVL   $0, CX
+	XGETBV
+	MOVL   AX, eax+0(FP)
+	MOVL   DX, edx+4(FP)
+	RET
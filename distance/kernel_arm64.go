@@ -0,0 +1,18 @@
+//go:build !purego
+
+package distance
+
+// NEON is part of arm64.
+
+//go:noescape
+func l2NEON(vec1, vec2 []float32, bound float32) float32
+
+//go:noescape
+func dotNEON(vec1, vec2 []float32) float32
+
+//go:noescape
+func cosineNEON(vec1, vec2 []float32) (dot, norm1, norm2 float32)
+
+func init() {
+	useKernels(kernelSet{name: "neon", l2: l2NEON, dot: dotNEON, cosine: cosineNEON})
+}
@@ -0,0 +1,166 @@
+//go:build !purego
+
+#include "textflag.h"
+
+// The kernels take two slices of the same length, the main loops consume whole registers of floats,
+// and the tails are handled by scalar instructions.
+// FADD, FSUB and FADDP are encoded by WORD, since older assemblers do not know the vector forms.
+
+// func l2NEON(vec1, vec2 []float32, bound float32) float32
+TEXT ·l2NEON(SB), NOSPLIT, $0-60
+	MOVD  vec1_base+0(FP), R0
+	MOVD  vec2_base+24(FP), R1
+	MOVD  vec1_len+8(FP), R2
+	FMOVS bound+48(FP), F8
+	MOVD  $64, R3
+	VEOR  V0.B16, V0.B16, V0.B16
+	VEOR  V1.B16, V1.B16, V1.B16
+
+loop8:
+	CMP    $8, R2
+	BLT    loop4
+	VLD1.P 32(R0), [V2.S4, V3.S4]
+	VLD1.P 32(R1), [V4.S4, V5.S4]
+	WORD   $0x4EA4D442 // FSUB V2.4S, V2.4S, V4.4S
+	WORD   $0x4EA5D463 // FSUB V3.4S, V3.4S, V5.4S
+	VFMLA  V2.S4, V2.S4, V0.S4
+	VFMLA  V3.S4, V3.S4, V1.S4
+	SUB    $8, R2
+	SUBS   $8, R3
+	BNE    loop8
+	MOVD   $64, R3
+	WORD   $0x4E21D407 // FADD V7.4S, V0.4S, V1.4S
+	WORD   $0x6E27D4E7 // FADDP V7.4S, V7.4S, V7.4S
+	WORD   $0x7E30D8E7 // FADDP S7, V7.2S
+	FCMPS  F8, F7
+	BGT    abandon
+	B      loop8
+
+loop4:
+	WORD   $0x4E21D400 // FADD V0.4S, V0.4S, V1.4S
+	CMP    $4, R2
+	BLT    reduce
+	VLD1.P 16(R0), [V2.S4]
+	VLD1.P 16(R1), [V4.S4]
+	WORD   $0x4EA4D442 // FSUB V2.4S, V2.4S, V4.4S
+	VFMLA  V2.S4, V2.S4, V0.S4
+	SUB    $4, R2
+
+reduce:
+	WORD $0x6E20D400 // FADDP V0.4S, V0.4S, V0.4S
+	WORD $0x7E30D800 // FADDP S0, V0.2S
+
+tail:
+	CBZ   R2, done
+	FMOVS (R0), F2
+	FMOVS (R1), F4
+	FSUBS F4, F2, F2
+	FMULS F2, F2, F2
+	FADDS F2, F0, F0
+	ADD   $4, R0
+	ADD   $4, R1
+	SUB   $1, R2
+	B     tail
+
+done:
+	FMOVS F0, ret+56(FP)
+	RET
+
+abandon:
+	FMOVS F7, ret+56(FP)
+	RET
+
+// func dotNEON(vec1, vec2 []float32) float32
+TEXT ·dotNEON(SB), NOSPLIT, $0-52
+	MOVD vec1_base+0(FP), R0
+	MOVD vec2_base+24(FP), R1
+	MOVD vec1_len+8(FP), R2
+	VEOR V0.B16, V0.B16, V0.B16
+	VEOR V1.B16, V1.B16, V1.B16
+
+loop8:
+	CMP    $8, R2
+	BLT    loop4
+	VLD1.P 32(R0), [V2.S4, V3.S4]
+	VLD1.P 32(R1), [V4.S4, V5.S4]
+	VFMLA  V4.S4, V2.S4, V0.S4
+	VFMLA  V5.S4, V3.S4, V1.S4
+	SUB    $8, R2
+	B      loop8
+
+loop4:
+	WORD   $0x4E21D400 // FADD V0.4S, V0.4S, V1.4S
+	CMP    $4, R2
+	BLT    reduce
+	VLD1.P 16(R0), [V2.S4]
+	VLD1.P 16(R1), [V4.S4]
+	VFMLA  V4.S4, V2.S4, V0.S4
+	SUB    $4, R2
+
+reduce:
+	WORD $0x6E20D400 // FADDP V0.4S, V0.4S, V0.4S
+	WORD $0x7E30D800 // FADDP S0, V0.2S
+
+tail:
+	CBZ   R2, done
+	FMOVS (R0), F2
+	FMOVS (R1), F4
+	FMULS F4, F2, F2
+	FADDS F2, F0, F0
+	ADD   $4, R0
+	ADD   $4, R1
+	SUB   $1, R2
+	B     tail
+
+done:
+	FMOVS F0, ret+48(FP)
+	RET
+
+// func cosineNEON(vec1, vec2 []float32) (dot, norm1, norm2 float32)
+TEXT ·cosineNEON(SB), NOSPLIT, $0-60
+	MOVD vec1_base+0(FP), R0
+	MOVD vec2_base+24(FP), R1
+	MOVD vec1_len+8(FP), R2
+	VEOR V0.B16, V0.B16, V0.B16
+	VEOR V1.B16, V1.B16, V1.B16
+	VEOR V6.B16, V6.B16, V6.B16
+
+loop4:
+	CMP    $4, R2
+	BLT    reduce
+	VLD1.P 16(R0), [V2.S4]
+	VLD1.P 16(R1), [V4.S4]
+	VFMLA  V4.S4, V2.S4, V0.S4
+	VFMLA  V2.S4, V2.S4, V1.S4
+	VFMLA  V4.S4, V4.S4, V6.S4
+	SUB    $4, R2
+	B      loop4
+
+reduce:
+	WORD $0x6E20D400 // FADDP V0.4S, V0.4S, V0.4S
+	WORD $0x7E30D800 // FADDP S0, V0.2S
+	WORD $0x6E21D421 // FADDP V1.4S, V1.4S, V1.4S
+	WORD $0x7E30D821 // FADDP S1, V1.2S
+	WORD $0x6E26D4C6 // FADDP V6.4S, V6.4S, V6.4S
+	WORD $0x7E30D8C6 // FADDP S6, V6.2S
+
+tail:
+	CBZ   R2, done
+	FMOVS (R0), F2
+	FMOVS (R1), F4
+	FMULS F4, F2, F5
+	FADDS F5, F0, F0
+	FMULS F2, F2, F5
+	FADDS F5, F1, F1
+	FMULS F4, F4, F5
+	FADDS F5, F6, F6
+	ADD   $4, R0
+	ADD   $4, R1
+	SUB   $1, R2
+	B     tail
+
+done:
+	FMOVS F0, dot+48(FP)
+	FMOVS F1, norm1+52(FP)
+	FMOVS F6, norm2+56(FP)
+	RET
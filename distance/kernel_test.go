@@ -0,0 +1,125 @@
+package distance
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// nearlyEqual reports whether the kernel result got is close to want, scale is the sum of the absolute values of
+// the terms, which bounds the rounding error of any summation order.
+func nearlyEqual(got, want, scale float32) bool {
+	return math.Abs(float64(got-want)) <= 1e-5*math.Max(1, float64(scale))
+}
+
+func TestKernelEquivalence(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	buf1, buf2 := make([]float32, 300), make([]float32, 300)
+	for i := range buf1 {
+		buf1[i] = r.Float32()*20 - 10
+		buf2[i] = r.Float32()*20 - 10
+	}
+	for _, kernels := range kernelSets[1:] {
+		// every length around the register widths, and unaligned starts
+		for n := 0; n <= 260; n++ {
+			for offset := 0; offset < 4; offset++ {
+				vec1, vec2 := buf1[offset:offset+n], buf2[3-offset:3-offset+n]
+				l2Scale, dotScale, norm1Scale, norm2Scale := float32(0), float32(0), float32(0), float32(0)
+				for i := range vec1 {
+					l2Scale += (vec1[i] - vec2[i]) * (vec1[i] - vec2[i])
+					dotScale += float32(math.Abs(float64(vec1[i] * vec2[i])))
+					norm1Scale += vec1[i] * vec1[i]
+					norm2Scale += vec2[i] * vec2[i]
+				}
+				if got, want := kernels.l2(vec1, vec2, math.MaxFloat32), l2Generic(vec1, vec2, math.MaxFloat32); !nearlyEqual(got, want, l2Scale) {
+					t.Fatalf("[%v] l2 of length [%v]: [%v], expect: [%v]", kernels.name, n, got, want)
+				}
+				if got, want := kernels.dot(vec1, vec2), dotGeneric(vec1, vec2); !nearlyEqual(got, want, dotScale) {
+					t.Fatalf("[%v] dot of length [%v]: [%v], expect: [%v]", kernels.name, n, got, want)
+				}
+				dot, norm1, norm2 := kernels.cosine(vec1, vec2)
+				wantDot, wantNorm1, wantNorm2 := cosineGeneric(vec1, vec2)
+				if !nearlyEqual(dot, wantDot, dotScale) || !nearlyEqual(norm1, wantNorm1, norm1Scale) ||
+					!nearlyEqual(norm2, wantNorm2, norm2Scale) {
+					t.Fatalf("[%v] cosine of length [%v]: [%v %v %v], expect: [%v %v %v]",
+						kernels.name, n, dot, norm1, norm2, wantDot, wantNorm1, wantNorm2)
+				}
+			}
+		}
+		// special values are passed through
+		inf := []float32{float32(math.Inf(1)), 1, 2, 3, 4, 5, 6, 7, 8}
+		if got := kernels.dot(inf, inf); !math.IsInf(float64(got), 1) {
+			t.Fatalf("[%v] dot of inf: [%v]", kernels.name, got)
+		}
+	}
+	if KernelName() != kernelSets[len(kernelSets)-1].name {
+		t.Fatalf("kernels in use: [%v], expect the last supported: [%v]", KernelName(), kernelSets[len(kernelSets)-1].name)
+	}
+}
+
+func TestBoundedL2(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for _, kernels := range kernelSets {
+		for _, n := range []int{0, 7, 63, 64, 65, 128, 200, 960} {
+			vec1, vec2 := make([]float32, n), make([]float32, n)
+			for i := range vec1 {
+				vec1[i], vec2[i] = r.Float32(), r.Float32()
+			}
+			dis := kernels.l2(vec1, vec2, math.MaxFloat32)
+			// the same sum for every bound not exceeded, and a partial sum greater than bound otherwise
+			for _, bound := range []float32{dis, dis * 2, float32(math.Inf(1)), float32(math.NaN())} {
+				if got := kernels.l2(vec1, vec2, bound); got != dis {
+					t.Fatalf("[%v] l2 of length [%v] with bound [%v]: [%v], expect: [%v]", kernels.name, n, bound, got, dis)
+				}
+			}
+			for _, bound := range []float32{0, dis / 4, dis / 2, dis * 0.99} {
+				if got := kernels.l2(vec1, vec2, bound); dis > bound && (got <= bound || got > dis*1.001) {
+					t.Fatalf("[%v] l2 of length [%v] with bound [%v]: [%v], expect in (bound, [%v]]",
+						kernels.name, n, bound, got, dis)
+				}
+			}
+		}
+		// the partial sum of the first 64 dimensions exceeds bound already
+		vec1, vec2 := make([]float32, 960), make([]float32, 960)
+		for i := range vec1 {
+			vec1[i] = 1
+		}
+		if got := kernels.l2(vec1, vec2, 10); got != boundedBlockSize {
+			t.Fatalf("[%v] l2 abandoned at: [%v], expect: [%v]", kernels.name, got, boundedBlockSize)
+		}
+	}
+	if got := L2DistanceBounded([]float32{0, 0}, []float32{3, 4}, 1); got <= 1 {
+		t.Fatalf("bounded l2: [%v], expect greater than bound", got)
+	}
+	if got := BoundedFuncMap[InnerProduct]([]float32{1, 2}, []float32{3, 4}, -100); got != -11 {
+		t.Fatalf("unbounded inner product: [%v], expect: [-11]", got)
+	}
+}
+
+func BenchmarkKernels(b *testing.B) {
+	for _, dim := range []int{8, 128, 960} {
+		vec1, vec2 := make([]float32, dim), make([]float32, dim)
+		for i := range vec1 {
+			vec1[i], vec2[i] = rand.Float32(), rand.Float32()
+		}
+		for _, kernels := range kernelSets {
+			b.Run(fmt.Sprintf("%v/l2/%v", kernels.name, dim), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					kernels.l2(vec1, vec2, math.MaxFloat32)
+				}
+			})
+			// a bound exceeded by the first block, like the distance of a far neighbor
+			b.Run(fmt.Sprintf("%v/l2_bounded/%v", kernels.name, dim), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					kernels.l2(vec1, vec2, 1)
+				}
+			})
+			b.Run(fmt.Sprintf("%v/cosine/%v", kernels.name, dim), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					kernels.cosine(vec1, vec2)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package distance
+
+import (
+	"fmt"
+
+	"github.com/shiyinong/hnsw-go/util"
+)
+
+// Properties describes a distance, they are given to Register for custom distances.
+type Properties struct {
+	// the distance comes from a similarity, higher is more similar. The function given to Register returns the
+	// similarity, which is negated to a distance for the indexes, and the score of a result is the similarity.
+	// The score of other distances is 1 / (1 + distance)
+	IsSimilarity bool
+	// vectors of docs and queries are normalized to unit length before they are passed to the function
+	RequiresNormalization bool
+	// the distance is a true metric, which satisfies the triangle inequality
+	IsMetric bool
+}
+
+type registration struct {
+	name  string
+	props Properties
+}
+
+var (
+	registry = map[Type]registration{
+		// the squared L2 distance violates the triangle inequality
+		L2:           {name: "l2"},
+		Cosine:       {name: "cosine", props: Properties{IsSimilarity: true}},
+		InnerProduct: {name: "inner_product", props: Properties{IsSimilarity: true}},
+		Hamming:      {name: "hamming", props: Properties{IsMetric: true}},
+	}
+	typesByName = map[string]Type{
+		"l2":            L2,
+		"cosine":        Cosine,
+		"inner_product": InnerProduct,
+		"hamming":       Hamming,
+	}
+)
+
+// Register adds a custom distance named name, and returns its Type to build the indexes. Index files record
+// the distance by name, so a custom distance should be registered with the same name before an index using
+// it is loaded. Register is not safe to call concurrently with the indexes, call it in init.
+func Register(name string, fn func(vec1, vec2 []float32) float32, props Properties) (Type, error) {
+	if name == "" || fn == nil {
+		return 0, fmt.Errorf("%w: name and function of a distance should not be empty", util.ErrInvalidParam)
+	}
+	if _, ok := typesByName[name]; ok {
+		return 0, fmt.Errorf("%w: distance [%v] has been registered", util.ErrDuplicateKey, name)
+	}
+	t := Type(len(registry))
+	disFunc, scoreFunc := fn, L2Score
+	if props.IsSimilarity {
+		disFunc = func(vec1, vec2 []float32) float32 {
+			return -fn(vec1, vec2)
+		}
+		scoreFunc = InnerProductScore
+	}
+	registry[t] = registration{name: name, props: props}
+	typesByName[name] = t
+	FuncMap[t] = disFunc
+	BoundedFuncMap[t] = Unbounded(disFunc)
+	ScoreFuncMap[t] = scoreFunc
+	return t, nil
+}
+
+// Lookup returns the Type of the distance named name, ok is false if it is not registered.
+func Lookup(name string) (t Type, ok bool) {
+	t, ok = typesByName[name]
+	return t, ok
+}
+
+// Name returns the registered name of t, or an empty string if t is not registered.
+func (t Type) Name() string {
+	return registry[t].name
+}
+
+func (t Type) String() string {
+	if name := t.Name(); name != "" {
+		return name
+	}
+	return fmt.Sprintf("Type(%d)", int32(t))
+}
+
+// Properties returns the properties of t, the zero value is returned if t is not registered.
+func (t Type) Properties() Properties {
+	return registry[t].props
+}
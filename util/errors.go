@@ -0,0 +1,17 @@
+package util
+
+import (
+	"errors"
+)
+
+var (
+	ErrDimensionMismatch = errors.New("dimension mismatch")
+	ErrEmptyIndex        = errors.New("empty index")
+	ErrInvalidParam      = errors.New("invalid param")
+	ErrInvalidId         = errors.New("invalid id")
+	ErrDuplicateId       = errors.New("duplicate id")
+	ErrDuplicateKey      = errors.New("duplicate key")
+	ErrCorruptFile       = errors.New("corrupt file")
+	// the distance of an index file is not registered by distance.Register
+	ErrUnregisteredDistance = errors.New("unregistered distance")
+)
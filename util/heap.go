@@ -31,6 +31,12 @@ func NewMaxHeap() *Heap {
 	)
 }
 
+// Reset removes all elements and keeps the capacity.
+func (h *Heap) Reset() {
+	clear(h.Elements)
+	h.Elements = h.Elements[:0]
+}
+
 func (h *Heap) Size() int {
 	return len(h.Elements)
 }
@@ -68,6 +74,12 @@ func (h *Heap) PopAndPush(ele HeapEle) HeapEle {
 	return res
 }
 
+// Fix restores the heap order after the value of the element at i has changed.
+func (h *Heap) Fix(i int) {
+	h.fixUp(i)
+	h.fixDown(i)
+}
+
 func (h *Heap) fixUp(child int) {
 	for {
 		parent := (child - 1) / 2
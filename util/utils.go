@@ -2,6 +2,7 @@ package util
 
 import (
 	"encoding/binary"
+	"fmt"
 	"io"
 )
 
@@ -12,6 +13,13 @@ func Min[T int32 | int64 | int](n1, n2 T) T {
 	return n2
 }
 
+func Max[T int32 | int64 | int](n1, n2 T) T {
+	if n1 > n2 {
+		return n1
+	}
+	return n2
+}
+
 func ReadValue[T int | int32 | int64 | float32 | float64](r io.Reader) T {
 	var i T
 	err := binary.Read(r, binary.LittleEndian, &i)
@@ -27,3 +35,56 @@ func WriteValue[T int | int32 | int64 | float32 | float64](v T, w io.Writer) {
 		panic(err)
 	}
 }
+
+// ErrReader keeps the first error of the reads, the following reads do nothing and return zero values.
+type ErrReader struct {
+	R   io.Reader
+	Err error
+}
+
+// ErrWriter keeps the first error of the writes, the following writes do nothing.
+type ErrWriter struct {
+	W   io.Writer
+	Err error
+}
+
+func TryReadValue[T int | int32 | int64 | float32 | float64](r *ErrReader) T {
+	var i T
+	if r.Err != nil {
+		return i
+	}
+	r.Err = binary.Read(r.R, binary.LittleEndian, &i)
+	return i
+}
+
+func TryWriteValue[T int | int32 | int64 | float32 | float64](v T, w *ErrWriter) {
+	if w.Err != nil {
+		return
+	}
+	w.Err = binary.Write(w.W, binary.LittleEndian, &v)
+}
+
+// max length of the strings read by TryReadString
+const maxStringLen = 1 << 24
+
+func TryReadString(r *ErrReader) string {
+	size := TryReadValue[int32](r)
+	if r.Err != nil {
+		return ""
+	}
+	if size < 0 || size > maxStringLen {
+		r.Err = fmt.Errorf("%w: invalid string length: [%v]", ErrCorruptFile, size)
+		return ""
+	}
+	buf := make([]byte, size)
+	_, r.Err = io.ReadFull(r.R, buf)
+	return string(buf)
+}
+
+func TryWriteString(v string, w *ErrWriter) {
+	TryWriteValue[int32](int32(len(v)), w)
+	if w.Err != nil {
+		return
+	}
+	_, w.Err = io.WriteString(w.W, v)
+}